@@ -14,6 +14,8 @@ const (
 	Get
 	Write
 	Delete
+	Stream
+	StreamLines
 )
 
 type serviceRoute struct {
@@ -29,6 +31,7 @@ type ServiceBuilder struct {
 	root         string
 	server       *Server
 	store        storage.RWCache
+	sessions     *Sessions
 	routes       []serviceRoute
 	resource     map[string]ResourceAdapter
 	defaultError ErrHandler
@@ -78,6 +81,7 @@ func (b *ServiceBuilder) AdaptResource(location string, new NewResourceFunc, con
 func (b *ServiceBuilder) End() *Service {
 	svc := &Service{
 		store:        b.store,
+		sessions:     b.sessions,
 		resource:     b.resource,
 		defaultError: b.defaultError,
 	}
@@ -89,6 +93,10 @@ func (b *ServiceBuilder) End() *Service {
 			h = svc.Get(r.resource, r.idParam)
 		case List:
 			h = svc.List(r.resource)
+		case Stream:
+			h = svc.Stream(r.resource, storage.StreamJSON)
+		case StreamLines:
+			h = svc.Stream(r.resource, storage.StreamNDJSON)
 		case Write:
 			h = svc.Write(r.resource, r.empty)
 		case Delete:
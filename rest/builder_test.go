@@ -27,6 +27,7 @@ var _ = Describe("Builder", func() {
 			err := sb.Resource("root", "childId").
 				Adapt(&namedAdapter{}).
 				GET("root", rest.List).
+				GET("stream/root", rest.Stream).
 				GET("root/:childId", rest.Get).
 				End()
 			Expect(err).NotTo(HaveOccurred())
@@ -55,6 +56,18 @@ var _ = Describe("Builder", func() {
 				Expect(actual).To(Equal(expected))
 			})
 
+			It("should stream resources", func() {
+				expected, err := store.ReadList("root/")
+				Expect(err).NotTo(HaveOccurred())
+
+				rp, err = test.GET(server, "/stream/root")
+				Expect(rp.StatusCode).To(Equal(200))
+
+				actual, err := io.ReadAll(rp.Body)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(actual).To(Equal(expected))
+			})
+
 			It("should list nested resources", func() {
 				expected, err := store.ReadList("root/child1/nest/")
 				Expect(err).NotTo(HaveOccurred())
@@ -8,6 +8,7 @@ import (
 	"net/http/httptest"
 	"regexp"
 	"strings"
+	"sync"
 
 	"github.com/julienschmidt/httprouter"
 )
@@ -18,12 +19,21 @@ var (
 
 type Options struct {
 	LogPrefix string
+
+	// Sessions isolates the mutations made by each session, as selected by the SessionHeader
+	// or SessionCookie, in every service built by the server.
+	Sessions bool
+	// SessionPath, if set, routes "DELETE <SessionPath>/:session" to drop a session's state.
+	SessionPath string
 }
 
 type Server struct {
 	logPrefix string
 	Server    *httptest.Server
 	Router    *httprouter.Router
+	mu        sync.Mutex
+	isolate   bool
+	sessions  map[storage.RWCache]*Sessions
 }
 
 func (srv *Server) defaultNotFound(w http.ResponseWriter, rq *http.Request) {
@@ -45,9 +55,14 @@ func NewServer(options Options) *Server {
 		logPrefix: options.LogPrefix,
 		Server:    httptest.NewServer(router),
 		Router:    router,
+		isolate:   options.Sessions,
+		sessions:  map[storage.RWCache]*Sessions{},
 	}
 
 	router.NotFound = http.HandlerFunc(server.defaultNotFound)
+	if options.Sessions && options.SessionPath != "" {
+		router.DELETE(strings.TrimSuffix(options.SessionPath, "/")+"/:session", server.dropSessionHandler)
+	}
 
 	return server
 }
@@ -56,8 +71,21 @@ func (srv *Server) BuildService(root string, store storage.RWCache) *ServiceBuil
 	if !strings.HasSuffix(root, "/") {
 		root += "/"
 	}
+
+	// Services built on the same store share its sessions
+	var sessions *Sessions
+	if srv.isolate {
+		srv.mu.Lock()
+		if sessions = srv.sessions[store]; sessions == nil {
+			sessions = NewSessions(store)
+			srv.sessions[store] = sessions
+		}
+		srv.mu.Unlock()
+	}
+
 	return &ServiceBuilder{
 		store:        store,
+		sessions:     sessions,
 		server:       srv,
 		root:         root,
 		routes:       []serviceRoute{},
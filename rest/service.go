@@ -2,9 +2,11 @@ package rest
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github/joekhoobyar/epigon/storage"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/julienschmidt/httprouter"
@@ -15,6 +17,7 @@ type ErrHandler func(http.ResponseWriter, *http.Request, httprouter.Params, erro
 type Service struct {
 	resource     map[string]ResourceAdapter
 	store        storage.RWCache
+	sessions     *Sessions
 	defaultError ErrHandler
 }
 
@@ -31,9 +34,37 @@ func NewService(store storage.RWCache) *Service {
 	}
 }
 
+// NewSessionService creates a service that isolates the mutations made by each session
+// in its own fork of the store.  See Sessions.
+func NewSessionService(store storage.RWCache) *Service {
+	svc := NewService(store)
+	svc.sessions = NewSessions(store)
+	return svc
+}
+
+// Sessions returns the service's sessions, or nil if it does not isolate sessions.
+func (svc *Service) Sessions() *Sessions {
+	return svc.sessions
+}
+
+// storeFor returns the store for the session selected by a request, if any.
+func (svc *Service) storeFor(rq *http.Request) (storage.RWCache, error) {
+	if svc.sessions == nil {
+		return svc.store, nil
+	}
+	return svc.sessions.Store(SessionID(rq))
+}
+
+// ErrPreconditionFailed reports an If-Match header that does not hold a valid ETag.
+var ErrPreconditionFailed = errors.New("precondition failed")
+
 func defaultErrorHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params, err error) {
 	var msg string
-	w.WriteHeader(599)
+	if storage.IsVersionConflict(err) || errors.Is(err, ErrPreconditionFailed) {
+		w.WriteHeader(412)
+	} else {
+		w.WriteHeader(599)
+	}
 	if err != nil {
 		msg = err.Error()
 	}
@@ -87,13 +118,45 @@ func (svc *Service) List(locationTemplate string) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		var location string
 		var buff []byte
+		var store storage.RWCache
+		var err error
+
+		if location, err = LocateResource(locationTemplate, ps); err == nil {
+			if store, err = svc.storeFor(r); err == nil {
+				if buff, err = store.ReadList(location); err == nil {
+					w.WriteHeader(200)
+					w.Write(buff) // nolint
+					return
+				}
+			}
+		}
+
+		svc.defaultError(w, r, ps, err)
+	}
+}
+
+// Stream creates a list handler like List, except that it streams the resources from the
+// data store a page at a time, using chunked encoding, in the given format.  Errors can only
+// be reported until the first page has been streamed.
+//
+// NOTE:  The locationTemplate refers to a location in the data store, not an HTTP route.
+func (svc *Service) Stream(locationTemplate string, format storage.StreamFormat) httprouter.Handle {
+	if !strings.HasSuffix(locationTemplate, "/") {
+		locationTemplate += "/"
+	}
+
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		var location string
+		var store storage.RWCache
 		var err error
 
 		if location, err = LocateResource(locationTemplate, ps); err == nil {
-			if buff, err = svc.store.ReadList(location); err == nil {
-				w.WriteHeader(200)
-				w.Write(buff) // nolint
-				return
+			if store, err = svc.storeFor(r); err == nil {
+				sw := &streamWriter{ResponseWriter: w, format: format}
+				if err = storage.StreamList(sw, store, location, format); err == nil || sw.started {
+					sw.start()
+					return
+				}
 			}
 		}
 
@@ -101,6 +164,35 @@ func (svc *Service) List(locationTemplate string) httprouter.Handle {
 	}
 }
 
+// streamWriter starts a successful response just before the first write, so that any
+// error before then can still be reported.
+type streamWriter struct {
+	http.ResponseWriter
+	format  storage.StreamFormat
+	started bool
+}
+
+func (sw *streamWriter) start() {
+	if !sw.started {
+		sw.started = true
+		if sw.format == storage.StreamNDJSON {
+			sw.Header().Set("Content-Type", "application/x-ndjson")
+		}
+		sw.WriteHeader(200)
+	}
+}
+
+func (sw *streamWriter) Write(b []byte) (int, error) {
+	sw.start()
+	return sw.ResponseWriter.Write(b)
+}
+
+func (sw *streamWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 // Get creates a handler for the given data store location template.   The handler will
 // respond with the resource that matches the data store location.
 //
@@ -111,16 +203,20 @@ func (svc *Service) Get(locationTemplate, idParam string) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		var location string
 		var buff []byte
+		var store storage.RWCache
 		var err error
 
 		id := ps.ByName(idParam)
 
 		if location, err = LocateResource(locationTemplate, ps); err == nil {
 			location += "/" + id
-			if buff, err = svc.store.Read(location); err == nil {
-				w.WriteHeader(200)
-				w.Write(buff) // nolint
-				return
+			if store, err = svc.storeFor(r); err == nil {
+				if buff, err = store.Read(location); err == nil {
+					setMetadata(w, store, location)
+					w.WriteHeader(200)
+					w.Write(buff) // nolint
+					return
+				}
 			}
 		}
 
@@ -128,6 +224,16 @@ func (svc *Service) Get(locationTemplate, idParam string) httprouter.Handle {
 	}
 }
 
+// setMetadata sets the ETag and Last-Modified headers to describe an object, if it exists.
+func setMetadata(w http.ResponseWriter, store storage.RCache, location string) {
+	if meta, err := store.Stat(location); err == nil {
+		w.Header().Set("ETag", "\""+strconv.FormatUint(meta.Version, 36)+"\"")
+		if !meta.Updated.IsZero() {
+			w.Header().Set("Last-Modified", meta.Updated.UTC().Format(http.TimeFormat))
+		}
+	}
+}
+
 // Write creates a handler for the given data store location template.   The handler will
 // write a resource to the data store at a corresponding location, after appending the
 // id returned by the resource adapter's convert function.
@@ -139,6 +245,7 @@ func (svc *Service) Write(locationTemplate string, empty bool) httprouter.Handle
 	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		var location, id string
 		var buff []byte
+		var store storage.RWCache
 		var err error
 		var in, out any
 
@@ -151,17 +258,22 @@ func (svc *Service) Write(locationTemplate string, empty bool) httprouter.Handle
 				if id, out, err = resource.Convert(r, in); err == nil {
 					location += "/" + id
 					if buff, err = json.Marshal(out); err == nil {
-						if err = svc.store.Write(location, buff); err == nil {
-							w.WriteHeader(200)
-							if !empty {
-								w.Write(buff) // nolint
+						if store, err = svc.storeFor(r); err == nil {
+							if err = writeTo(store, r, location, buff); err == nil {
+								setMetadata(w, store, location)
+								w.WriteHeader(200)
+								if !empty {
+									w.Write(buff) // nolint
+								}
+								return
 							}
-							return
 						}
 					}
 				}
 			}
 		}
+
+		svc.defaultError(w, r, ps, err)
 	}
 }
 
@@ -176,21 +288,70 @@ func (svc *Service) Delete(locationTemplate, idParam string, empty bool) httprou
 	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		var location string
 		var buff []byte
+		var store storage.RWCache
 		var err error
 
 		id := ps.ByName(idParam)
 
 		if location, err = LocateResource(locationTemplate, ps); err == nil {
 			location += "/" + id
-			if existed := svc.store.Delete(location); existed {
-				w.WriteHeader(204)
-				w.Write(buff) // nolint
-				return
-			} else {
-				err = fmt.Errorf("%s: not found", location)
+			if store, err = svc.storeFor(r); err == nil {
+				if err = deleteFrom(store, r, location); err == nil {
+					w.WriteHeader(204)
+					w.Write(buff) // nolint
+					return
+				}
 			}
 		}
 
 		svc.defaultError(w, r, ps, err)
 	}
 }
+
+// precondition returns the version required by a request's If-Match header, which must
+// hold an ETag set by setMetadata, or 0 if "If-None-Match: *" requires that there is no
+// such resource yet.  "If-Match: *" requires the version the resource has now, so it fails
+// if there is no such resource.  Weak ETags and lists of ETags never match.  It returns
+// false if there is no precondition.
+func precondition(store storage.RWCache, rq *http.Request, location string) (version uint64, ok bool, err error) {
+	if etag := rq.Header.Get("If-Match"); etag == "*" {
+		if meta, err := store.Stat(location); err == nil {
+			return meta.Version, true, nil
+		}
+		return 0, true, fmt.Errorf("If-Match: %s: %w", etag, ErrPreconditionFailed)
+	} else if strings.HasPrefix(etag, "W/") {
+		// If-Match uses the strong comparison, which no weak ETag ever passes
+		return 0, true, fmt.Errorf("If-Match: %s: %w", etag, ErrPreconditionFailed)
+	} else if etag != "" {
+		etag = strings.Trim(etag, "\"")
+		if version, err = strconv.ParseUint(etag, 36, 64); err != nil || version == 0 {
+			return 0, true, fmt.Errorf("If-Match: %s: %w", etag, ErrPreconditionFailed)
+		}
+		return version, true, nil
+	} else if rq.Header.Get("If-None-Match") == "*" {
+		return 0, true, nil
+	}
+	return 0, false, nil
+}
+
+// writeTo writes a resource, as long as any precondition holds.
+func writeTo(store storage.RWCache, rq *http.Request, location string, buff []byte) error {
+	if version, ok, err := precondition(store, rq, location); err != nil {
+		return err
+	} else if ok {
+		return store.WriteIf(location, buff, version)
+	}
+	return store.Write(location, buff)
+}
+
+// deleteFrom deletes a resource, as long as any precondition holds.
+func deleteFrom(store storage.RWCache, rq *http.Request, location string) error {
+	if version, ok, err := precondition(store, rq, location); err != nil {
+		return err
+	} else if ok {
+		return store.DeleteIf(location, version)
+	} else if !store.Delete(location) {
+		return fmt.Errorf("%s: not found", location)
+	}
+	return nil
+}
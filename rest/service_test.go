@@ -5,6 +5,7 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 	. "github.com/onsi/ginkgo/v2"
@@ -171,6 +172,57 @@ var _ = Describe("Service", func() {
 
 		})
 
+		Context("Stream()", func() {
+			var hndl httprouter.Handle
+
+			It("should stream resources as a JSON array", func() {
+				hndl = svc.Stream("root", storage.StreamJSON)
+				ps = httprouter.Params{}
+				expected, err := store.ReadList("root/")
+				Expect(err).NotTo(HaveOccurred())
+
+				rq = httptest.NewRequest("GET", "/root", nil)
+				hndl(w, rq, ps)
+				rp = w.Result()
+				Expect(rp.StatusCode).To(Equal(200))
+				Expect(w.Flushed).To(BeTrue())
+
+				actual, err := io.ReadAll(rp.Body)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(actual).To(Equal(expected))
+			})
+
+			It("should stream nested resources as JSON lines", func() {
+				hndl = svc.Stream("root/:childId/nest", storage.StreamNDJSON)
+				ps = httprouter.Params{
+					httprouter.Param{Key: "childId", Value: "child1"},
+				}
+
+				rq = httptest.NewRequest("GET", "/root/child1/nest", nil)
+				hndl(w, rq, ps)
+				rp = w.Result()
+				Expect(rp.StatusCode).To(Equal(200))
+				Expect(rp.Header.Get("Content-Type")).To(Equal("application/x-ndjson"))
+
+				actual, err := io.ReadAll(rp.Body)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(bytes.Count(actual, []byte("\n"))).To(Equal(2))
+			})
+
+			It("should error if resources do not exist", func() {
+				hndl = svc.Stream("root/:childId/nest", storage.StreamJSON)
+				ps = httprouter.Params{
+					httprouter.Param{Key: "childId", Value: "child3"},
+				}
+
+				rq = httptest.NewRequest("GET", "/root/child3/nest", nil)
+				hndl(w, rq, ps)
+				rp = w.Result()
+				Expect(rp.StatusCode).To(Equal(599))
+			})
+
+		})
+
 		Context("Get()", func() {
 			var hndl httprouter.Handle
 
@@ -181,11 +233,15 @@ var _ = Describe("Service", func() {
 				}
 				expected, err := store.Read("root/child1")
 				Expect(err).NotTo(HaveOccurred())
+				meta, err := store.Stat("root/child1")
+				Expect(err).NotTo(HaveOccurred())
 
 				rq = httptest.NewRequest("GET", "/root/child1", nil)
 				hndl(w, rq, ps)
 				rp = w.Result()
 				Expect(rp.StatusCode).To(Equal(200))
+				Expect(rp.Header.Get("ETag")).NotTo(BeEmpty())
+				Expect(http.ParseTime(rp.Header.Get("Last-Modified"))).To(BeTemporally("~", meta.Updated, time.Second))
 
 				actual, err := io.ReadAll(rp.Body)
 				Expect(err).NotTo(HaveOccurred())
@@ -245,6 +301,13 @@ var _ = Describe("Service", func() {
 				hndl(w, rq, ps)
 				rp = w.Result()
 				Expect(rp.StatusCode).To(Equal(200))
+				etag := rp.Header.Get("ETag")
+				Expect(etag).NotTo(BeEmpty())
+
+				// Writing again changes the ETag
+				w = httptest.NewRecorder()
+				hndl(w, httptest.NewRequest("POST", "/root", bytes.NewReader(buff)), ps)
+				Expect(w.Result().Header.Get("ETag")).NotTo(Equal(etag))
 
 				stored, err := store.Read("root/child3")
 				Expect(err).NotTo(HaveOccurred())
@@ -257,6 +320,56 @@ var _ = Describe("Service", func() {
 
 		})
 
+		Context("Write() with preconditions", func() {
+			var hndl httprouter.Handle
+
+			BeforeEach(func() {
+				hndl = svc.Write("root", false)
+				ps = httprouter.Params{}
+			})
+
+			write := func(header, value string) *http.Response {
+				w := httptest.NewRecorder()
+				rq := httptest.NewRequest("PUT", "/root/child1", bytes.NewReader([]byte("{\"name\":\"child1\"}")))
+				rq.Header.Set(header, value)
+				hndl(w, rq, ps)
+				return w.Result()
+			}
+
+			It("should write if the ETag matches", func() {
+				etag := write("If-Match", "").Header.Get("ETag")
+				rp = write("If-Match", etag)
+				Expect(rp.StatusCode).To(Equal(200))
+				Expect(rp.Header.Get("ETag")).NotTo(Equal(etag))
+				Expect(write("If-Match", etag).StatusCode).To(Equal(412))
+			})
+			It("should only create if asked to", func() {
+				Expect(write("If-None-Match", "*").StatusCode).To(Equal(412))
+				Expect(store.Delete("root/child1")).To(BeTrue())
+				Expect(write("If-None-Match", "*").StatusCode).To(Equal(200))
+			})
+			It("should only replace if asked to", func() {
+				rp = write("If-Match", "*")
+				Expect(rp.StatusCode).To(Equal(200))
+				Expect(rp.Header.Get("ETag")).NotTo(BeEmpty())
+				Expect(store.Delete("root/child1")).To(BeTrue())
+				Expect(write("If-Match", "*").StatusCode).To(Equal(412))
+				Expect(store.Exists("root/child1")).To(BeFalse())
+			})
+			It("should fail on invalid ETags", func() {
+				Expect(write("If-Match", "\"?\"").StatusCode).To(Equal(412))
+			})
+			It("should fail on weak ETags", func() {
+				etag := write("If-Match", "").Header.Get("ETag")
+				Expect(write("If-Match", "W/"+etag).StatusCode).To(Equal(412))
+				Expect(write("If-Match", etag).StatusCode).To(Equal(200))
+			})
+			It("should fail on lists of ETags", func() {
+				etag := write("If-Match", "").Header.Get("ETag")
+				Expect(write("If-Match", etag+", \"1\"").StatusCode).To(Equal(412))
+			})
+		})
+
 		Context("Delete()", func() {
 			var hndl httprouter.Handle
 
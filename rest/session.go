@@ -0,0 +1,101 @@
+package rest
+
+import (
+	"github/joekhoobyar/epigon/storage"
+	"net/http"
+	"sync"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// SessionHeader names the request header that selects a session.
+	SessionHeader = "X-Epigon-Session"
+	// SessionCookie names the cookie that selects a session, if there is no SessionHeader.
+	SessionCookie = "epigon-session"
+)
+
+// Sessions isolates the mutations made by each session from every other session.  Each
+// session is lazily given its own fork of a base store the first time it is used, so the
+// base store must be a storage.Forker.  Requests without a session use the base store.
+type Sessions struct {
+	base   storage.RWCache
+	mu     sync.Mutex
+	stores map[string]storage.RWCache
+}
+
+func NewSessions(base storage.RWCache) *Sessions {
+	return &Sessions{
+		base:   base,
+		stores: map[string]storage.RWCache{},
+	}
+}
+
+// SessionID returns the session selected by a request, or "" if there is none.
+func SessionID(rq *http.Request) string {
+	if id := rq.Header.Get(SessionHeader); id != "" {
+		return id
+	} else if cookie, err := rq.Cookie(SessionCookie); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+// Store returns the store for a session, forking the base store if the session is new.
+func (s *Sessions) Store(id string) (storage.RWCache, error) {
+	if id == "" {
+		return s.base, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if store, ok := s.stores[id]; ok {
+		return store, nil
+	}
+
+	forker, ok := s.base.(storage.Forker)
+	if !ok {
+		return nil, storage.ErrForksUnsupported
+	}
+	store, err := forker.Fork()
+	if err == nil {
+		s.stores[id] = store
+	}
+	return store, err
+}
+
+// Drop discards a session's store, returning whether the session existed.  The session
+// will start over from the base store's contents if it is used again.
+func (s *Sessions) Drop(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.stores[id]
+	delete(s.stores, id)
+	return ok
+}
+
+// DropAll discards the stores of every session.
+func (s *Sessions) DropAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stores = map[string]storage.RWCache{}
+}
+
+// DropSession discards a session's stores in every service built by this server.
+func (srv *Server) DropSession(id string) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	var ok bool
+	for _, sessions := range srv.sessions {
+		ok = sessions.Drop(id) || ok
+	}
+	return ok
+}
+
+func (srv *Server) dropSessionHandler(w http.ResponseWriter, rq *http.Request, ps httprouter.Params) {
+	if srv.DropSession(ps.ByName("session")) {
+		w.WriteHeader(204)
+	} else {
+		w.WriteHeader(404)
+	}
+}
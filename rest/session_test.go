@@ -0,0 +1,145 @@
+package rest_test
+
+import (
+	"io"
+	"net/http"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github/joekhoobyar/epigon/rest"
+	"github/joekhoobyar/epigon/storage"
+	"github/joekhoobyar/epigon/test"
+)
+
+var _ = Describe("Sessions", func() {
+	var server *rest.Server
+	var store *storage.UnionedCache
+
+	exchange := func(method, path, body, session string) (int, string) {
+		var rd io.Reader
+		if body != "" {
+			rd = strings.NewReader(body)
+		}
+		rq, err := http.NewRequest(method, server.Server.URL+path, rd)
+		Expect(err).NotTo(HaveOccurred())
+		if session != "" {
+			rq.Header.Set(rest.SessionHeader, session)
+		}
+		rp, err := http.DefaultClient.Do(rq)
+		Expect(err).NotTo(HaveOccurred())
+		defer rp.Body.Close()
+		actual, err := io.ReadAll(rp.Body)
+		Expect(err).NotTo(HaveOccurred())
+		return rp.StatusCode, string(actual)
+	}
+	send := func(method, path, body, session string) int {
+		status, _ := exchange(method, path, body, session)
+		return status
+	}
+
+	BeforeEach(func() {
+		store = storage.NewUnionedCache(test.FixtureDir())
+		server = rest.NewServer(rest.Options{Sessions: true, SessionPath: "/_sessions"})
+		sb := server.BuildService("/", store)
+
+		err := sb.Resource("root", "childId").
+			Adapt(&namedAdapter{}).
+			GET("root", rest.List).
+			GET("root/:childId", rest.Get).
+			POST("root", rest.Write, false).
+			DELETE("root/:childId", rest.Delete, true).
+			End()
+		Expect(err).NotTo(HaveOccurred())
+		sb.End()
+	})
+
+	AfterEach(func() { server.Server.Close() })
+
+	It("should isolate each session's writes", func() {
+		Expect(send("POST", "/root", "{\"name\":\"child3\"}", "a")).To(Equal(200))
+		Expect(send("DELETE", "/root/child1", "", "b")).To(Equal(204))
+
+		_, body := exchange("GET", "/root", "", "a")
+		Expect(body).To(Equal("[{\"name\":\"baby\"},{\"name\":\"kid\"},{\"name\":\"child3\"}]"))
+		_, body = exchange("GET", "/root", "", "b")
+		Expect(body).To(Equal("[{\"name\":\"kid\"}]"))
+		_, body = exchange("GET", "/root", "", "")
+		Expect(body).To(Equal("[{\"name\":\"baby\"},{\"name\":\"kid\"}]"))
+		Expect(store.Exists("root/child3")).To(BeFalse())
+	})
+
+	It("should share writes made without a session", func() {
+		Expect(send("POST", "/root", "{\"name\":\"child3\"}", "")).To(Equal(200))
+		Expect(send("GET", "/root/child3", "", "a")).To(Equal(200))
+	})
+
+	It("should select sessions by cookie", func() {
+		Expect(send("DELETE", "/root/child1", "", "a")).To(Equal(204))
+
+		rq, err := http.NewRequest("GET", server.Server.URL+"/root/child1", nil)
+		Expect(err).NotTo(HaveOccurred())
+		rq.AddCookie(&http.Cookie{Name: rest.SessionCookie, Value: "a"})
+		rp, err := http.DefaultClient.Do(rq)
+		Expect(err).NotTo(HaveOccurred())
+		rp.Body.Close()
+		Expect(rp.StatusCode).To(Equal(599))
+	})
+
+	It("should drop a session's state", func() {
+		Expect(send("DELETE", "/root/child1", "", "a")).To(Equal(204))
+		Expect(server.DropSession("a")).To(BeTrue())
+		Expect(server.DropSession("a")).To(BeFalse())
+		Expect(send("GET", "/root/child1", "", "a")).To(Equal(200))
+	})
+
+	It("should drop a session's state over HTTP", func() {
+		Expect(send("DELETE", "/root/child1", "", "a")).To(Equal(204))
+		Expect(send("DELETE", "/_sessions/a", "", "")).To(Equal(204))
+		Expect(send("DELETE", "/_sessions/a", "", "")).To(Equal(404))
+		Expect(send("GET", "/root/child1", "", "a")).To(Equal(200))
+	})
+
+	It("should share sessions between services on the same store", func() {
+		sb := server.BuildService("/v2/", store)
+		err := sb.Resource("root", "childId").
+			Adapt(&namedAdapter{}).
+			GET("root/:childId", rest.Get).
+			End()
+		Expect(err).NotTo(HaveOccurred())
+		sb.End()
+
+		Expect(send("POST", "/root", "{\"name\":\"child3\"}", "a")).To(Equal(200))
+		Expect(send("GET", "/v2/root/child3", "", "a")).To(Equal(200))
+		Expect(send("GET", "/v2/root/child3", "", "b")).To(Equal(599))
+		Expect(server.DropSession("a")).To(BeTrue())
+		Expect(send("GET", "/v2/root/child3", "", "a")).To(Equal(599))
+	})
+
+	It("should fork stores wrapped in faulty caches", func() {
+		faulty := storage.NewFaultyCache(storage.NewUnionedCache(test.FixtureDir()))
+		sb := server.BuildService("/faulty/", faulty)
+		err := sb.Resource("root", "childId").
+			Adapt(&namedAdapter{}).
+			GET("root/:childId", rest.Get).
+			POST("root", rest.Write, false).
+			End()
+		Expect(err).NotTo(HaveOccurred())
+		sb.End()
+
+		Expect(send("POST", "/faulty/root", "{\"name\":\"child3\"}", "a")).To(Equal(200))
+		Expect(send("GET", "/faulty/root/child3", "", "a")).To(Equal(200))
+		Expect(send("GET", "/faulty/root/child3", "", "")).To(Equal(599))
+
+		faulty.Inject(storage.Fault{Ops: []string{"Read"}, Err: storage.ErrInjectedFault})
+		status, body := exchange("GET", "/faulty/root/child3", "", "a")
+		Expect(status).To(Equal(599))
+		Expect(body).To(ContainSubstring(storage.ErrInjectedFault.Error()))
+	})
+
+	It("should fail for stores that cannot be forked", func() {
+		svc := rest.NewSessionService(storage.NewFileStorage(GinkgoT().TempDir()))
+		Expect(svc.Sessions().Store("a")).Error().To(MatchError(storage.ErrForksUnsupported))
+	})
+})
@@ -1,11 +1,35 @@
 package storage
 
+import (
+	"slices"
+	"strings"
+	"time"
+)
+
+// Metadata describes an object.  Its version increases every time the object is written.
+type Metadata struct {
+	Location string
+	Version  uint64
+	Size     int
+	Created  time.Time
+	Updated  time.Time
+}
+
 type RCache interface {
 	Clear()
 	Exists(location string) bool
 	Read(location string) ([]byte, error)
+	// Stat describes an object without reading it.
+	Stat(location string) (Metadata, error)
 	ReadList(location string) ([]byte, error)
+	// List lists the objects directly beneath a prefix, leaving out any nested deeper.
 	List(location string) ([]string, error)
+	// ListTree lists the objects beneath a prefix, up to depth levels deep, or at any depth
+	// if depth is less than 1.  A depth of 1 lists the same objects as List.  A location of
+	// "" lists from the root of the store.
+	ListTree(location string, depth int) ([]string, error)
+	// ReadPage reads a page of the objects directly beneath a prefix.  See PageOptions.
+	ReadPage(location string, options PageOptions) (*Page, error)
 }
 
 type RWCache interface {
@@ -13,4 +37,83 @@ type RWCache interface {
 	Reset()
 	Write(location string, object []byte) error
 	Delete(location string) bool
+	// DeleteTree deletes every object nested beneath a location, along with the object
+	// at the location itself unless it ends in "/".  It returns whether anything existed.
+	DeleteTree(location string) bool
+	// WriteIf writes an object only if its current version matches, or only if there is no
+	// such object if the version is 0.  Otherwise it fails with ErrVersionConflict.
+	WriteIf(location string, object []byte, version uint64) error
+	// DeleteIf deletes an object only if its current version matches.  Otherwise it fails
+	// with ErrVersionConflict, or ErrObjectNotFound if there is no such object.
+	DeleteIf(location string, version uint64) error
+}
+
+// checkVersion checks the current version of an object, where version 0 means there is
+// no such object, against the version expected by WriteIf or DeleteIf.
+func checkVersion(location string, current, expected uint64) error {
+	if current != expected {
+		return newError(location, ErrVersionConflict)
+	}
+	return nil
+}
+
+// checkDelete checks the current version of an object against the version expected by
+// DeleteIf.
+func checkDelete(location string, current, expected uint64) error {
+	if current == 0 {
+		return newError(location, ErrObjectNotFound)
+	}
+	return checkVersion(location, current, expected)
+}
+
+// treePrefix returns the object at the root of a tree (or "" if there is none), and the
+// prefix of every location nested beneath it.
+func treePrefix(location string) (object, prefix string) {
+	if strings.HasSuffix(location, "/") {
+		return "", location
+	}
+	return location, location + "/"
+}
+
+// inTree returns whether a location is part of a tree.
+func inTree(location, object, prefix string) bool {
+	return (object != "" && location == object) || strings.HasPrefix(location, prefix)
+}
+
+// listTree lists a tree one prefix at a time, given a function that lists the objects and
+// the nested prefixes directly beneath a prefix.  Nested prefixes that are not found are
+// skipped.
+func listTree(location string, depth int, children func(location string) (subkeys, prefixes []string, err error)) ([]string, error) {
+	subkeys, prefixes, err := children(location)
+	if err != nil || depth == 1 {
+		return subkeys, err
+	}
+	for _, prefix := range prefixes {
+		keys, err := listTree(prefix, depth-1, children)
+		if IsPrefixNotFound(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		subkeys = append(subkeys, keys...)
+	}
+	slices.Sort(subkeys)
+	return subkeys, nil
+}
+
+// pastDepth returns the length of the part of a location beneath a prefix that is within
+// depth levels of it, or -1 if the whole location is.
+func pastDepth(prefix, location string, depth int) int {
+	if depth < 1 {
+		return -1
+	}
+	rest := location[len(prefix):]
+	for i := range rest {
+		if rest[i] == '/' {
+			if depth--; depth == 0 {
+				return len(prefix) + i
+			}
+		}
+	}
+	return -1
 }
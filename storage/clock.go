@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the time.  Stores use a clock to timestamp objects, so tests can control it.
+type Clock interface {
+	Now() time.Time
+}
+
+// Clocked is implemented by stores whose clock can be replaced.
+type Clocked interface {
+	SetClock(clock Clock)
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// SystemClock tells the time from the operating system.  Stores use it by default.
+var SystemClock Clock = systemClock{}
+
+// ManualClock is a Clock that only changes when it is set or advanced.
+type ManualClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func NewManualClock(now time.Time) *ManualClock {
+	return &ManualClock{now: now}
+}
+
+func (c *ManualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *ManualClock) Set(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = now
+}
+
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
@@ -8,6 +8,8 @@ const (
 	ErrKindNotPrefix
 	ErrObjectNotFound
 	ErrPrefixNotFound
+	ErrInvalidToken
+	ErrVersionConflict
 )
 
 var (
@@ -19,6 +21,8 @@ var (
 		"not a prefix record",
 		"no such object record",
 		"no such prefix record",
+		"invalid page token",
+		"version does not match",
 	}
 )
 
@@ -65,6 +69,10 @@ func IsObjectNotFound(err error) bool { return IsError(err, ErrObjectNotFound) }
 
 func IsPrefixNotFound(err error) bool { return IsError(err, ErrPrefixNotFound) }
 
+func IsInvalidToken(err error) bool { return IsError(err, ErrInvalidToken) }
+
+func IsVersionConflict(err error) bool { return IsError(err, ErrVersionConflict) }
+
 func IsError(err error, kind int) bool {
 	e, ok := err.(*StorageError)
 	return ok && e.reason == kind
@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"errors"
+	"maps"
+	"slices"
+	"time"
+)
+
+var ErrExpiriesUnsupported = errors.New("storage: expiring objects is not supported")
+
+// Expirer is implemented by stores that can write objects which expire.
+type Expirer interface {
+	// WriteTTL writes an object that expires once ttl has passed on the store's clock.
+	// An expired object is deleted just as if Delete had been called, so it can no longer
+	// be read, listed or found.  Writing the object again without a TTL keeps it for good.
+	WriteTTL(location string, object []byte, ttl time.Duration) error
+}
+
+// expiries tracks when objects written with a TTL expire, shared by each Expirer
+// implementation.  Stores delete expired objects lazily, the next time they are used.
+type expiries struct {
+	at   map[string]time.Time
+	next time.Time
+}
+
+func (e *expiries) set(location string, at time.Time) {
+	if e.at == nil {
+		e.at = map[string]time.Time{}
+	}
+	e.at[location] = at
+	if e.next.IsZero() || at.Before(e.next) {
+		e.next = at
+	}
+}
+
+func (e *expiries) remove(location string) {
+	delete(e.at, location)
+}
+
+func (e *expiries) removeTree(object, prefix string) {
+	for location := range e.at {
+		if inTree(location, object, prefix) {
+			delete(e.at, location)
+		}
+	}
+}
+
+// due returns whether any object may have expired by now.
+func (e *expiries) due(now time.Time) bool {
+	return !e.next.IsZero() && !now.Before(e.next)
+}
+
+// take stops tracking every object that has expired by now, and returns their locations
+// in order.
+func (e *expiries) take(now time.Time) []string {
+	var expired []string
+	e.next = time.Time{}
+	for location, at := range e.at {
+		if !now.Before(at) {
+			expired = append(expired, location)
+			delete(e.at, location)
+		} else if e.next.IsZero() || at.Before(e.next) {
+			e.next = at
+		}
+	}
+	slices.Sort(expired)
+	return expired
+}
+
+func (e *expiries) clone() expiries {
+	return expiries{at: maps.Clone(e.at), next: e.next}
+}
@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// ExportOptions controls what Export writes.
+type ExportOptions struct {
+	// Delta only exports the objects in a UnionedCache's writable layer, leaving out any
+	// that are only in its read-only layers.  Deletes cannot be exported, since fixtures
+	// have no way to hide objects.
+	Delta bool
+}
+
+// Export writes every object in a store to a directory as a "<location>.json" file, in the
+// layout that FixtureStorage reads, so that the directory can be used as fixtures.  Any
+// other files already in the directory are left alone.
+func Export(c RCache, dir string, options ExportOptions) error {
+	if u, ok := c.(*UnionedCache); ok && options.Delta {
+		c = u.temp
+	}
+
+	locations, err := c.ListTree("", 0)
+	if IsPrefixNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, location := range locations {
+		if !fs.ValidPath(location) {
+			return wrapFailure(fs.ErrInvalid, location)
+		}
+		data, err := c.Read(location)
+		if IsObjectNotFound(err) {
+			continue // deleted by a concurrent writer since it was listed
+		} else if err != nil {
+			return err
+		}
+
+		name := filepath.Join(dir, filepath.FromSlash(location)) + ".json"
+		if err = os.MkdirAll(filepath.Dir(name), 0o755); err == nil {
+			err = os.WriteFile(name, data, 0o644)
+		}
+		if err != nil {
+			return wrapFailure(err, location)
+		}
+	}
+	return nil
+}
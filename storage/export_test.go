@@ -0,0 +1,62 @@
+package storage_test
+
+import (
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github/joekhoobyar/epigon/storage"
+	"github/joekhoobyar/epigon/test"
+)
+
+var _ = Describe("Export", func() {
+	var dir string
+	var u *storage.UnionedCache
+	child3 := []byte("{\"name\":\"teen\"}")
+
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+		u = storage.NewUnionedCache(test.FixtureDir())
+		Expect(u.Write("root/child3", child3)).To(Succeed())
+		Expect(u.Write("other/child1", child3)).To(Succeed())
+		Expect(u.DeleteTree("root/child1")).To(BeTrue())
+	})
+
+	It("should export the merged view as fixtures", func() {
+		Expect(storage.Export(u, dir, storage.ExportOptions{})).To(Succeed())
+
+		expected, err := u.ListTree("", 0)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(expected).To(ContainElements("root", "root/child2", "root/child3", "other/child1"))
+		Expect(expected).NotTo(ContainElement("root/child1"))
+
+		f := storage.NewFixtureStorage(dir)
+		Expect(f.ListTree("", 0)).To(Equal(expected))
+		for _, location := range expected {
+			data, err := u.Read(location)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(f.Read(location)).To(Equal(data))
+		}
+	})
+
+	It("should only export the writable layer as a delta", func() {
+		Expect(storage.Export(u, dir, storage.ExportOptions{Delta: true})).To(Succeed())
+		Expect(storage.NewFixtureStorage(dir).ListTree("", 0)).To(Equal([]string{"other/child1", "root/child3"}))
+		Expect(os.ReadFile(filepath.Join(dir, "root", "child3.json"))).To(Equal(child3))
+	})
+
+	It("should export an InMemoryCache", func() {
+		m := storage.NewInMemoryCache()
+		Expect(m.Write("root", child3)).To(Succeed())
+		Expect(m.Write("root/child1/nest/arm", child3)).To(Succeed())
+		Expect(storage.Export(m, dir, storage.ExportOptions{})).To(Succeed())
+		Expect(storage.NewFixtureStorage(dir).ListTree("", 0)).To(Equal([]string{"root", "root/child1/nest/arm"}))
+	})
+
+	It("should export nothing from an empty store", func() {
+		Expect(storage.Export(storage.NewInMemoryCache(), dir, storage.ExportOptions{})).To(Succeed())
+		Expect(os.ReadDir(dir)).To(BeEmpty())
+	})
+})
@@ -0,0 +1,317 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrInjectedFault is a convenient error for a Fault to return.
+var ErrInjectedFault = errors.New("storage: injected fault")
+
+// Fault injects latency, failures or both into operations on matching locations.
+type Fault struct {
+	// Ops lists the operations the fault applies to, by method name, such as "Write" or
+	// "List", or every operation if it is empty.
+	Ops []string
+	// Pattern matches locations using path.Match, except that a pattern ending in "/"
+	// matches every location beginning with it, and an empty pattern matches every location.
+	Pattern string
+	// Every only applies the fault to every Nth matching operation, counting from the
+	// first, or to every one if it is less than 2.
+	Every int
+	// Delay is how long to wait before each operation the fault applies to.
+	Delay time.Duration
+	// Err fails each operation the fault applies to, unless it is nil.  Operations that
+	// return a bool return false instead, and Clear and Reset only wait.
+	Err error
+}
+
+func (f *Fault) matches(op, location string) bool {
+	if len(f.Ops) > 0 {
+		var found bool
+		for i := 0; i < len(f.Ops) && !found; i++ {
+			found = f.Ops[i] == op
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.Pattern == "" {
+		return true
+	} else if strings.HasSuffix(f.Pattern, "/") {
+		return strings.HasPrefix(location, f.Pattern)
+	}
+	ok, _ := path.Match(f.Pattern, location)
+	return ok
+}
+
+// injected is a fault, along with how many operations it has matched.
+type injected struct {
+	Fault
+	count int
+}
+
+// faults are the faults injected into a FaultyCache, shared with its forks and transactions.
+type faults struct {
+	mu       sync.Mutex
+	injected []*injected
+}
+
+// FaultyCache wraps a store, injecting faults into operations before passing them on, so
+// that clients can be tested against failures and latency.  Injected failures are reported
+// as a *StorageError wrapping the fault's Err, unless Err is already a *StorageError.
+//
+// FaultyCache implements every optional interface, such as Forker and Transactor, by passing
+// operations on to the store if it implements them, or else failing as other stores do.
+// Forks and transactions share the faults injected into the FaultyCache, so faults injected
+// into a store behind rest.Sessions apply to every session.
+type FaultyCache struct {
+	RWCache
+	faults *faults
+}
+
+func NewFaultyCache(store RWCache) *FaultyCache {
+	return &FaultyCache{RWCache: store, faults: &faults{}}
+}
+
+// Inject adds a fault, which applies along with any injected before it.
+func (f *FaultyCache) Inject(fault Fault) {
+	f.faults.mu.Lock()
+	defer f.faults.mu.Unlock()
+	f.faults.injected = append(f.faults.injected, &injected{Fault: fault})
+}
+
+// Heal removes every fault.
+func (f *FaultyCache) Heal() {
+	f.faults.mu.Lock()
+	defer f.faults.mu.Unlock()
+	f.faults.injected = nil
+}
+
+// inject waits for the total delay of every fault that applies to an operation, and then
+// returns the error from the first of them that has one.
+func (f *FaultyCache) inject(op, location string) error {
+	var delay time.Duration
+	var err error
+
+	f.faults.mu.Lock()
+	for _, fault := range f.faults.injected {
+		if !fault.matches(op, location) {
+			continue
+		}
+		if fault.count++; fault.Every > 1 && fault.count%fault.Every != 0 {
+			continue
+		}
+		delay += fault.Delay
+		if err == nil && fault.Err != nil {
+			if err = fault.Err; !errors.As(err, new(*StorageError)) {
+				err = wrapFailure(err, location)
+			}
+		}
+	}
+	f.faults.mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	return err
+}
+
+func (f *FaultyCache) Clear() {
+	f.inject("Clear", "") // nolint: only waits
+	f.RWCache.Clear()
+}
+
+func (f *FaultyCache) Reset() {
+	f.inject("Reset", "") // nolint: only waits
+	f.RWCache.Reset()
+}
+
+func (f *FaultyCache) Exists(location string) bool {
+	return f.inject("Exists", location) == nil && f.RWCache.Exists(location)
+}
+
+func (f *FaultyCache) Read(location string) ([]byte, error) {
+	if err := f.inject("Read", location); err != nil {
+		return nil, err
+	}
+	return f.RWCache.Read(location)
+}
+
+func (f *FaultyCache) Stat(location string) (Metadata, error) {
+	if err := f.inject("Stat", location); err != nil {
+		return Metadata{}, err
+	}
+	return f.RWCache.Stat(location)
+}
+
+func (f *FaultyCache) ReadList(location string) ([]byte, error) {
+	if err := f.inject("ReadList", location); err != nil {
+		return nil, err
+	}
+	return f.RWCache.ReadList(location)
+}
+
+func (f *FaultyCache) List(location string) ([]string, error) {
+	if err := f.inject("List", location); err != nil {
+		return nil, err
+	}
+	return f.RWCache.List(location)
+}
+
+func (f *FaultyCache) ListTree(location string, depth int) ([]string, error) {
+	if err := f.inject("ListTree", location); err != nil {
+		return nil, err
+	}
+	return f.RWCache.ListTree(location, depth)
+}
+
+func (f *FaultyCache) ReadPage(location string, options PageOptions) (*Page, error) {
+	if err := f.inject("ReadPage", location); err != nil {
+		return nil, err
+	}
+	return f.RWCache.ReadPage(location, options)
+}
+
+func (f *FaultyCache) Write(location string, data []byte) error {
+	if err := f.inject("Write", location); err != nil {
+		return err
+	}
+	return f.RWCache.Write(location, data)
+}
+
+func (f *FaultyCache) WriteIf(location string, data []byte, version uint64) error {
+	if err := f.inject("WriteIf", location); err != nil {
+		return err
+	}
+	return f.RWCache.WriteIf(location, data, version)
+}
+
+func (f *FaultyCache) Delete(location string) bool {
+	return f.inject("Delete", location) == nil && f.RWCache.Delete(location)
+}
+
+func (f *FaultyCache) DeleteIf(location string, version uint64) error {
+	if err := f.inject("DeleteIf", location); err != nil {
+		return err
+	}
+	return f.RWCache.DeleteIf(location, version)
+}
+
+func (f *FaultyCache) DeleteTree(location string) bool {
+	return f.inject("DeleteTree", location) == nil && f.RWCache.DeleteTree(location)
+}
+
+// SetClock sets the store's clock, if it has one.
+func (f *FaultyCache) SetClock(clock Clock) {
+	if store, ok := f.RWCache.(Clocked); ok {
+		store.SetClock(clock)
+	}
+}
+
+func (f *FaultyCache) WriteTTL(location string, data []byte, ttl time.Duration) error {
+	if err := f.inject("WriteTTL", location); err != nil {
+		return err
+	}
+	store, ok := f.RWCache.(Expirer)
+	if !ok {
+		return ErrExpiriesUnsupported
+	}
+	return store.WriteTTL(location, data, ttl)
+}
+
+// Watch closes the channel straight away if a fault fails it, or if the store is not a
+// Watcher.
+func (f *FaultyCache) Watch(ctx context.Context, prefix string) <-chan Event {
+	err := f.inject("Watch", prefix)
+	if store, ok := f.RWCache.(Watcher); ok && err == nil {
+		return store.Watch(ctx, prefix)
+	}
+	return closedEvents()
+}
+
+// Fork returns a FaultyCache wrapping a fork of the store, which shares the faults.
+func (f *FaultyCache) Fork() (RWCache, error) {
+	if err := f.inject("Fork", ""); err != nil {
+		return nil, err
+	}
+	store, ok := f.RWCache.(Forker)
+	if !ok {
+		return nil, ErrForksUnsupported
+	}
+	forked, err := store.Fork()
+	if err != nil {
+		return nil, err
+	}
+	return &FaultyCache{RWCache: forked, faults: f.faults}, nil
+}
+
+// Update injects faults into the operations of the transaction as well.
+func (f *FaultyCache) Update(fn func(tx RWCache) error) error {
+	if err := f.inject("Update", ""); err != nil {
+		return err
+	}
+	store, ok := f.RWCache.(Transactor)
+	if !ok {
+		return ErrTransactionsUnsupported
+	}
+	return store.Update(func(tx RWCache) error {
+		return fn(&FaultyCache{RWCache: tx, faults: f.faults})
+	})
+}
+
+// snapshotter injects faults into an operation on snapshots, and then returns the store.
+func (f *FaultyCache) snapshotter(op string) (Snapshotter, error) {
+	if err := f.inject(op, ""); err != nil {
+		return nil, err
+	}
+	store, ok := f.RWCache.(Snapshotter)
+	if !ok {
+		return nil, ErrSnapshotsUnsupported
+	}
+	return store, nil
+}
+
+func (f *FaultyCache) Snapshot() (*Snapshot, error) {
+	store, err := f.snapshotter("Snapshot")
+	if err != nil {
+		return nil, err
+	}
+	return store.Snapshot()
+}
+
+func (f *FaultyCache) Restore(snapshot *Snapshot) error {
+	store, err := f.snapshotter("Restore")
+	if err != nil {
+		return err
+	}
+	return store.Restore(snapshot)
+}
+
+func (f *FaultyCache) PushCheckpoint() error {
+	store, err := f.snapshotter("PushCheckpoint")
+	if err != nil {
+		return err
+	}
+	return store.PushCheckpoint()
+}
+
+func (f *FaultyCache) RollbackCheckpoint() error {
+	store, err := f.snapshotter("RollbackCheckpoint")
+	if err != nil {
+		return err
+	}
+	return store.RollbackCheckpoint()
+}
+
+func (f *FaultyCache) PopCheckpoint() error {
+	store, err := f.snapshotter("PopCheckpoint")
+	if err != nil {
+		return err
+	}
+	return store.PopCheckpoint()
+}
@@ -0,0 +1,96 @@
+package storage_test
+
+import (
+	"errors"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github/joekhoobyar/epigon/storage"
+)
+
+var _ = Describe("FaultyCache", func() {
+	var f *storage.FaultyCache
+	object := []byte("{\"name\":\"order\"}")
+
+	BeforeEach(func() {
+		f = storage.NewFaultyCache(storage.NewInMemoryCache())
+		var c storage.RWCache = f // force breakage if we fail to implement the interface
+		Expect(c.Write("orders/1", object)).To(Succeed())
+	})
+
+	It("should fail every Nth matching operation", func() {
+		f.Inject(storage.Fault{Ops: []string{"Write"}, Pattern: "orders/", Every: 3, Err: storage.ErrInjectedFault})
+		var failures []int
+		for i := 1; i <= 6; i++ {
+			if err := f.Write("orders/2", object); err != nil {
+				Expect(errors.Is(err, storage.ErrInjectedFault)).To(BeTrue())
+				Expect(err).To(MatchError(HavePrefix("orders/2: ")))
+				failures = append(failures, i)
+			}
+		}
+		Expect(failures).To(Equal([]int{3, 6}))
+		Expect(f.Write("other", object)).To(Succeed())
+		Expect(f.Read("orders/1")).To(Equal(object))
+	})
+
+	It("should match locations with patterns", func() {
+		f.Inject(storage.Fault{Pattern: "orders/?", Err: storage.ErrInjectedFault})
+		_, err := f.Read("orders/1")
+		Expect(err).To(HaveOccurred())
+		Expect(f.Exists("orders/1")).To(BeFalse())
+		Expect(f.Delete("orders/1")).To(BeFalse())
+		Expect(f.List("orders/")).To(Equal([]string{"orders/1"}))
+	})
+
+	It("should keep storage errors as they are", func() {
+		conflict := f.WriteIf("orders/1", object, 0)
+		Expect(storage.IsVersionConflict(conflict)).To(BeTrue())
+		f.Inject(storage.Fault{Ops: []string{"Write"}, Err: conflict})
+		Expect(storage.IsVersionConflict(f.Write("orders/2", object))).To(BeTrue())
+	})
+
+	It("should delay matching operations", func() {
+		f.Inject(storage.Fault{Ops: []string{"List"}, Pattern: "orders/", Delay: 50 * time.Millisecond})
+		start := time.Now()
+		Expect(f.Read("orders/1")).To(Equal(object))
+		Expect(time.Since(start)).To(BeNumerically("<", 50*time.Millisecond))
+		Expect(f.List("orders/")).To(Equal([]string{"orders/1"}))
+		Expect(time.Since(start)).To(BeNumerically(">=", 50*time.Millisecond))
+	})
+
+	It("should share faults with forks and transactions", func() {
+		fork, err := f.Fork()
+		Expect(err).NotTo(HaveOccurred())
+		f.Inject(storage.Fault{Ops: []string{"Write"}, Pattern: "orders/2", Err: storage.ErrInjectedFault})
+		Expect(fork.Write("orders/2", object)).To(MatchError(storage.ErrInjectedFault))
+		Expect(fork.Write("orders/3", object)).To(Succeed())
+		Expect(f.Exists("orders/3")).To(BeFalse())
+
+		err = f.Update(func(tx storage.RWCache) error {
+			Expect(tx.Write("orders/3", object)).To(Succeed())
+			return tx.Write("orders/2", object)
+		})
+		Expect(err).To(MatchError(storage.ErrInjectedFault))
+		Expect(f.Exists("orders/3")).To(BeFalse())
+	})
+
+	It("should fail operations the store does not support", func() {
+		f = storage.NewFaultyCache(storage.NewFileStorage(GinkgoT().TempDir()))
+		Expect(f.Fork()).Error().To(MatchError(storage.ErrForksUnsupported))
+		Expect(f.Snapshot()).Error().To(MatchError(storage.ErrSnapshotsUnsupported))
+		Expect(f.WriteTTL("orders/1", object, time.Minute)).To(MatchError(storage.ErrExpiriesUnsupported))
+		Expect(f.Update(func(tx storage.RWCache) error {
+			return tx.Write("orders/1", object)
+		})).To(Succeed())
+		Expect(f.Read("orders/1")).To(Equal(object))
+	})
+
+	It("should stop injecting faults once healed", func() {
+		f.Inject(storage.Fault{Err: storage.ErrInjectedFault})
+		Expect(f.Write("orders/2", object)).NotTo(Succeed())
+		f.Heal()
+		Expect(f.Write("orders/2", object)).To(Succeed())
+	})
+})
@@ -0,0 +1,667 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileStorage persists objects as "<location>.json" files under a directory, in the same
+// layout that FixtureStorage reads.  Each write goes to a temporary file that is atomically
+// renamed into place, so readers never see partially written objects.  Each file's
+// modification time is taken from the clock, while the object's version and creation time
+// are kept in a hidden ".<name>.meta" file beside it.  Versions are counted in a hidden
+// ".version" file in the directory, so they keep increasing across restarts, deletes and
+// changes to the clock.
+type FileStorage struct {
+	Dir      string
+	mu       sync.RWMutex
+	commits  sync.RWMutex // held by each commit, and shared by readers
+	gen      uint64
+	cache    map[string]record
+	clock    Clock
+	version  uint64 // the last version written, or the least version to write after
+	watchers watchers
+}
+
+// fileMeta is kept in the metadata file beside each object file written by a FileStorage.
+type fileMeta struct {
+	Version uint64    `json:"version"`
+	Created time.Time `json:"created"`
+}
+
+// metaName returns the name of the metadata file for an object, given the name of its
+// object file without the extension.
+func metaName(name string) string {
+	dir, base := filepath.Split(name)
+	return filepath.Join(dir, "."+base+".meta")
+}
+
+func NewFileStorage(dir string) *FileStorage {
+	return &FileStorage{
+		Dir:   dir,
+		cache: map[string]record{},
+		clock: SystemClock,
+	}
+}
+
+func (s *FileStorage) SetClock(clock Clock) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clock = clock
+}
+
+// Watch reports changes made through this FileStorage, but not any made to its files by
+// anything else.
+func (s *FileStorage) Watch(ctx context.Context, prefix string) <-chan Event {
+	return s.watchers.watch(ctx, prefix)
+}
+
+func (s *FileStorage) Clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gen++
+	s.cache = map[string]record{}
+}
+
+// Reset removes every object file and its metadata, and any directories left empty, from the
+// directory.  The version counter is kept, so that versions never repeat.
+func (s *FileStorage) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gen++
+	s.cache = map[string]record{}
+
+	var dirs []string
+	filepath.WalkDir(s.Dir, func(name string, d fs.DirEntry, err error) error { // nolint
+		if err != nil {
+			return nil
+		} else if d.IsDir() {
+			dirs = append(dirs, name)
+		} else if strings.HasSuffix(name, ".json") || strings.HasPrefix(d.Name(), ".") && strings.HasSuffix(name, ".meta") {
+			os.Remove(name) // nolint
+		}
+		return nil
+	})
+	for i := len(dirs) - 1; i > 0; i-- {
+		os.Remove(dirs[i]) // nolint: fails unless the directory is empty
+	}
+}
+
+// lookup returns a cached record, along with the generation it was read at.
+func (s *FileStorage) lookup(location string) (r record, ok bool, gen uint64) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	r, ok = s.cache[location]
+	return r, ok, s.gen
+}
+
+// remember caches a record that was computed outside the lock, unless a write
+// has happened since gen was read, in which case the record may be stale.
+func (s *FileStorage) remember(gen uint64, location string, r record) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.gen == gen {
+		s.cache[location] = r
+	}
+}
+
+// filename returns the OS path for a location, without any extension.
+func (s *FileStorage) filename(location string) (string, error) {
+	if location != "" && !fs.ValidPath(location) {
+		return "", wrapFailure(fs.ErrInvalid, location)
+	}
+	return filepath.Join(s.Dir, filepath.FromSlash(location)), nil
+}
+
+// The readers below wait for any commit in progress, so that they never see part of one,
+// and then read the files without holding the write lock.
+
+func (s *FileStorage) Read(location string) ([]byte, error) {
+	s.commits.RLock()
+	defer s.commits.RUnlock()
+	return s.read(location)
+}
+
+// Stat describes an object using its metadata file for its version and creation time, and
+// its file's modification time for its update time.  Objects in files written by anything
+// else are described like fixtures, with version 1.
+func (s *FileStorage) Stat(location string) (Metadata, error) {
+	s.commits.RLock()
+	defer s.commits.RUnlock()
+	return s.stat(location)
+}
+
+func (s *FileStorage) Exists(location string) bool {
+	s.commits.RLock()
+	defer s.commits.RUnlock()
+	return s.exists(location)
+}
+
+func (s *FileStorage) List(location string) ([]string, error) {
+	s.commits.RLock()
+	defer s.commits.RUnlock()
+	return s.list(location)
+}
+
+func (s *FileStorage) ListTree(location string, depth int) ([]string, error) {
+	s.commits.RLock()
+	defer s.commits.RUnlock()
+	return s.listTree(location, depth)
+}
+
+func (s *FileStorage) ReadPage(location string, options PageOptions) (*Page, error) {
+	s.commits.RLock()
+	defer s.commits.RUnlock()
+	return s.readPage(location, options)
+}
+
+func (s *FileStorage) ReadList(location string) ([]byte, error) {
+	s.commits.RLock()
+	defer s.commits.RUnlock()
+	return s.readList(location)
+}
+
+func (s *FileStorage) read(location string) ([]byte, error) {
+	if strings.HasSuffix(location, "/") {
+		return nil, newError(location, ErrLocationNotObject)
+	}
+
+	r, ok, gen := s.lookup(location)
+	if ok {
+		if r.kind() != kindObject {
+			return nil, newError(location, ErrKindNotObject)
+		}
+		return r.(objectRecord).data, nil
+	}
+
+	name, err := s.filename(location)
+	if err != nil {
+		return nil, err
+	}
+	buff, err := os.ReadFile(name + ".json")
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, wrapError(err, location, ErrObjectNotFound)
+	} else if err != nil {
+		return nil, wrapFailure(err, location)
+	}
+
+	// cache the result and return it
+	s.remember(gen, location, objectRecord{data: buff})
+	return buff, nil
+}
+
+func (s *FileStorage) stat(location string) (Metadata, error) {
+	if strings.HasSuffix(location, "/") {
+		return Metadata{}, newError(location, ErrLocationNotObject)
+	}
+	name, err := s.filename(location)
+	if err != nil {
+		return Metadata{}, err
+	}
+	info, err := os.Stat(name + ".json")
+	if errors.Is(err, fs.ErrNotExist) {
+		return Metadata{}, wrapError(err, location, ErrObjectNotFound)
+	} else if err != nil {
+		return Metadata{}, wrapFailure(err, location)
+	}
+	meta := fileMetadata(location, int(info.Size()), info)
+	if m, err := readMeta(name); err == nil {
+		meta.Version, meta.Created = m.Version, m.Created
+	}
+	return meta, nil
+}
+
+// readMeta reads the metadata file for an object, given the name of its object file without
+// the extension.
+func readMeta(name string) (m fileMeta, err error) {
+	buff, err := os.ReadFile(metaName(name))
+	if err == nil {
+		err = json.Unmarshal(buff, &m)
+	}
+	return m, err
+}
+
+func (s *FileStorage) exists(location string) bool {
+	if r, ok, _ := s.lookup(location); ok {
+		return r.kind() == kindObject
+	} else if strings.HasSuffix(location, "/") {
+		return false
+	} else if name, err := s.filename(location); err != nil {
+		return false
+	} else {
+		return isFile(name + ".json")
+	}
+}
+
+// isFile returns whether there is a regular file with a name.  It does not use the cache,
+// so it may be called with or without the lock.
+func isFile(name string) bool {
+	info, err := os.Stat(name)
+	return err == nil && info.Mode().IsRegular()
+}
+
+func (s *FileStorage) list(location string) ([]string, error) {
+	if !strings.HasSuffix(location, "/") {
+		return nil, newError(location, ErrLocationNotPrefix)
+	}
+
+	// Return the data if it is cached
+	r, ok, gen := s.lookup(location)
+	if ok {
+		if r.kind() != kindCollection {
+			return nil, newError(location, ErrKindNotPrefix)
+		}
+		return r.(collectionRecord).subkeys, nil
+	}
+
+	subkeys, _, err := s.children(location)
+	if err != nil {
+		return nil, err
+	}
+
+	// cache the result and return it
+	s.remember(gen, location, collectionRecord{subkeys: subkeys})
+	return subkeys, nil
+}
+
+func (s *FileStorage) listTree(location string, depth int) ([]string, error) {
+	if location != "" && !strings.HasSuffix(location, "/") {
+		return nil, newError(location, ErrLocationNotPrefix)
+	} else if depth == 1 && location != "" {
+		return s.list(location)
+	}
+	return listTree(location, depth, s.children)
+}
+
+// children lists the objects directly beneath a prefix, along with the nested prefixes of
+// any directories beneath it.
+func (s *FileStorage) children(location string) (subkeys, prefixes []string, err error) {
+	subdir, _ := strings.CutSuffix(location, "/")
+	dir, err := s.filename(subdir)
+	if err != nil {
+		return nil, nil, err
+	}
+	files, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		// Directories are only created when their first object is written, so treat
+		// the collection as empty as long as its parent object exists.  Its file is
+		// checked directly, since DeleteTree lists trees with the write lock held.
+		if parent := path.Dir(subdir); parent != "." && !isFile(filepath.Dir(dir)+".json") {
+			return nil, nil, wrapError(err, location, ErrPrefixNotFound)
+		}
+	} else if err != nil {
+		return nil, nil, wrapFailure(err, location)
+	}
+
+	// List the JSON files, skipping any temporary files
+	subkeys = make([]string, 0, len(files))
+	for i := range files {
+		name := files[i].Name()
+		if strings.HasPrefix(name, ".") {
+			continue
+		} else if files[i].IsDir() {
+			prefixes = append(prefixes, path.Join(location, name)+"/")
+		} else if basename, has := strings.CutSuffix(name, ".json"); has {
+			subkeys = append(subkeys, path.Join(location, basename))
+		}
+	}
+	slices.Sort(subkeys)
+	return subkeys, prefixes, nil
+}
+
+func (s *FileStorage) readPage(location string, options PageOptions) (*Page, error) {
+	subkeys, err := s.list(location)
+	if err != nil {
+		return nil, err
+	}
+	return readPage(location, subkeys, options, s.read)
+}
+
+func (s *FileStorage) readList(location string) ([]byte, error) {
+	if !strings.HasSuffix(location, "/") {
+		return nil, newError(location, ErrLocationNotPrefix)
+	}
+
+	// Hydrate the file list if the data is not cached.
+	var subkeys []string
+	var err error
+	r, ok, gen := s.lookup(location)
+	if !ok {
+		subkeys, err = s.list(location)
+		if err != nil {
+			return nil, err
+		}
+	} else if r.kind() != kindCollection {
+		return nil, newError(location, ErrKindNotPrefix)
+	} else if r.(collectionRecord).data != nil {
+		return r.(collectionRecord).data, nil
+	} else {
+		subkeys = r.(collectionRecord).subkeys
+	}
+
+	// Build an object record for this collection.
+	buff := bytes.Buffer{}
+	buff.WriteString("[")
+	for _, subkey := range subkeys {
+		data, err := s.read(subkey)
+		if IsObjectNotFound(err) {
+			continue // deleted by a concurrent writer since it was listed
+		} else if err != nil {
+			return nil, err
+		}
+		if buff.Len() > 1 {
+			buff.WriteString(",")
+		}
+		buff.Write(data)
+	}
+	buff.WriteString("]")
+
+	// Cache the result and return it
+	b := buff.Bytes()
+	s.remember(gen, location, collectionRecord{data: b, subkeys: subkeys})
+	return b, nil
+}
+
+func (s *FileStorage) Write(location string, data []byte) error {
+	if strings.HasSuffix(location, "/") {
+		return newError(location, ErrLocationNotObject)
+	}
+	name, err := s.filename(location)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.write(location, name, data)
+}
+
+// WriteIf only checks versions against writes made through this FileStorage, since any
+// other process could write the file at the same time.
+func (s *FileStorage) WriteIf(location string, data []byte, version uint64) error {
+	if strings.HasSuffix(location, "/") {
+		return newError(location, ErrLocationNotObject)
+	}
+	name, err := s.filename(location)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err = checkVersion(location, s.current(location), version); err != nil {
+		return err
+	}
+	return s.write(location, name, data)
+}
+
+// current returns the version of an object, or 0 if there is no such object.
+func (s *FileStorage) current(location string) uint64 {
+	meta, err := s.stat(location)
+	if err != nil {
+		return 0
+	}
+	return meta.Version
+}
+
+// advance makes sure that every version written from now on is greater than floor.
+func (s *FileStorage) advance(floor uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.version < floor {
+		s.version = floor
+	}
+}
+
+// next counts a new version, greater than any written to the directory before and greater
+// than floor, and saves it before it is used.  It must be called with the write lock held.
+func (s *FileStorage) next(floor uint64, modified time.Time) (uint64, error) {
+	name := filepath.Join(s.Dir, ".version")
+	if buff, err := os.ReadFile(name); err == nil {
+		if saved, err := strconv.ParseUint(strings.TrimSpace(string(buff)), 10, 64); err == nil && saved > floor {
+			floor = saved
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return 0, err
+	}
+	if s.version > floor {
+		floor = s.version
+	}
+	if err := writeFileAtomic(name, []byte(strconv.FormatUint(floor+1, 10)), modified); err != nil {
+		return 0, err
+	}
+	s.version = floor + 1
+	return s.version, nil
+}
+
+// write must be called with the write lock held.
+func (s *FileStorage) write(location, name string, data []byte) error {
+	// Keep the creation time of any object being replaced, and save the metadata before the
+	// object, so that a failed write never leaves new data under an old version
+	modified := s.clock.Now()
+	replaced, err := s.stat(location)
+	m := fileMeta{Created: modified}
+	if err == nil {
+		m.Created = replaced.Created
+	}
+	if m.Version, err = s.next(replaced.Version, modified); err != nil {
+		return wrapFailure(err, location)
+	}
+	buff, _ := json.Marshal(m)
+	if err := writeFileAtomic(metaName(name), buff, modified); err != nil {
+		return wrapFailure(err, location)
+	}
+	if err := writeFileAtomic(name+".json", data, modified); err != nil {
+		return wrapFailure(err, location)
+	}
+	s.gen++
+	s.cache[location] = objectRecord{data: data}
+
+	// Invalidate any cached list
+	if parent := path.Dir(location); parent != "." {
+		delete(s.cache, parent+"/")
+	}
+
+	s.watchers.written(location, data, m.Version, replaced.Version != 0)
+	return nil
+}
+
+func (s *FileStorage) Delete(location string) bool {
+	if strings.HasSuffix(location, "/") {
+		return false
+	}
+	name, err := s.filename(location)
+	if err != nil {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.delete(location, name)
+}
+
+func (s *FileStorage) DeleteIf(location string, version uint64) error {
+	if strings.HasSuffix(location, "/") {
+		return newError(location, ErrLocationNotObject)
+	}
+	name, err := s.filename(location)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err = checkDelete(location, s.current(location), version); err != nil {
+		return err
+	}
+	s.delete(location, name)
+	return nil
+}
+
+// delete must be called with the write lock held.
+func (s *FileStorage) delete(location, name string) bool {
+	err := os.Remove(name + ".json")
+	os.Remove(metaName(name)) // nolint: there is none for files written by anything else
+	s.gen++
+	delete(s.cache, location)
+
+	// Invalidate any cached list
+	if parent := path.Dir(location); parent != "." {
+		delete(s.cache, parent+"/")
+	}
+
+	if err == nil {
+		s.watchers.deleted(location)
+	}
+	return err == nil
+}
+
+func (s *FileStorage) DeleteTree(location string) bool {
+	object, prefix := treePrefix(location)
+	name, err := s.filename(strings.TrimSuffix(prefix, "/"))
+	if prefix == "/" || err != nil {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// List the tree before deleting it, if anyone is watching
+	var deleted []string
+	if s.watchers.active() {
+		deleted, _ = listTree(prefix, 0, s.children)
+		if object != "" && isFile(name+".json") {
+			deleted = append(deleted, object)
+		}
+	}
+
+	var ok bool
+	if object != "" {
+		ok = os.Remove(name+".json") == nil
+		os.Remove(metaName(name)) // nolint: there is none for files written by anything else
+	}
+	if _, err = os.Stat(name); err == nil {
+		ok = os.RemoveAll(name) == nil || ok
+	}
+	s.gen++
+
+	// Invalidate the tree, along with every cached list
+	for key, r := range s.cache {
+		if r.kind() == kindCollection || inTree(key, object, prefix) {
+			delete(s.cache, key)
+		}
+	}
+
+	// Only report the objects that are gone, in case some files could not be removed
+	for _, key := range deleted {
+		if name, err := s.filename(key); err == nil && !isFile(name+".json") {
+			s.watchers.deleted(key)
+		}
+	}
+	return ok
+}
+
+func (s *FileStorage) Update(fn func(tx RWCache) error) error {
+	return update(s, fn, s.commit)
+}
+
+// commit applies a transaction's changes while holding the write lock, restoring every
+// file already changed if any change fails.  Readers wait until it is done, and watchers
+// only see its events if every change was applied.
+func (s *FileStorage) commit(changes []change) error {
+	s.commits.Lock()
+	defer s.commits.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := checkChanges(changes, s.current); err != nil {
+		return err
+	}
+
+	// Keep the previous contents of each file, which are nil if there was none
+	names := make([]string, len(changes))
+	previous := make([][]byte, len(changes))
+	for i, c := range changes {
+		name, err := s.filename(c.location)
+		if err != nil {
+			return err
+		}
+		names[i] = name
+		if data, err := os.ReadFile(name + ".json"); err == nil {
+			previous[i] = data
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return wrapFailure(err, c.location)
+		}
+	}
+
+	s.watchers.hold()
+	for i, c := range changes {
+		var err error
+		if c.deleted {
+			s.delete(c.location, names[i])
+		} else {
+			err = s.write(c.location, names[i], c.data)
+		}
+		if err != nil {
+			s.undo(changes[:i], names, previous)
+			s.watchers.drop()
+			return err
+		}
+	}
+	s.watchers.release()
+	return nil
+}
+
+// undo restores the previous contents of files changed by a transaction.  It must be
+// called with the write lock held.
+func (s *FileStorage) undo(changes []change, names []string, previous [][]byte) {
+	for i, c := range changes {
+		if previous[i] == nil {
+			s.delete(c.location, names[i])
+		} else {
+			s.write(c.location, names[i], previous[i]) // nolint
+		}
+	}
+}
+
+// writeFileAtomic writes data to a temporary file in the same directory, and then renames
+// it over the named file, with the given modification time.
+func writeFileAtomic(name string, data []byte, modified time.Time) error {
+	dir, base := filepath.Split(name)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(dir, "."+base+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // nolint: fails once the rename succeeds
+
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0o644)
+	}
+	if err == nil {
+		err = os.Chtimes(f.Name(), modified, modified)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), name)
+	}
+	return err
+}
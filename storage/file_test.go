@@ -0,0 +1,354 @@
+package storage_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github/joekhoobyar/epigon/storage"
+)
+
+var _ = Describe("FileStorage", func() {
+	var root, child1, child2 []byte
+	var err error
+	var dir string
+	var s *storage.FileStorage
+
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+		s = storage.NewFileStorage(dir)
+		var c storage.RWCache = s // force breakage if we fail to implement the interface
+
+		root = []byte("{\"name\":\"root\"}")
+		err = c.Write("root", root)
+		Expect(err).NotTo(HaveOccurred())
+		child1 = []byte("{\"name\":\"baby\"}")
+		err = c.Write("root/child1", child1)
+		Expect(err).NotTo(HaveOccurred())
+		child2 = []byte("{\"name\":\"kid\"}")
+		err = c.Write("root/child2", child2)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	Describe("Reading locations", func() {
+
+		Context("that are objects", func() {
+			It("should load root", func() { Expect(s.Read("root")).To(Equal(root)) })
+			It("should load child1", func() { Expect(s.Read("root/child1")).To(Equal(child1)) })
+			It("should load child2", func() { Expect(s.Read("root/child2")).To(Equal(child2)) })
+		})
+
+		Context("that are lists", func() {
+			It("should report an error", func() {
+				_, err := s.Read("root/")
+				Expect(err).To(MatchError(HaveSuffix(" location does not identify an object")))
+			})
+		})
+
+		Context("that do not exist", func() {
+			It("should report an error", func() {
+				_, err = s.Read("missing")
+				Expect(storage.IsObjectNotFound(err)).To(BeTrue())
+			})
+		})
+
+		Context("that escape the directory", func() {
+			It("should report an error", func() {
+				_, err = s.Read("../missing")
+				Expect(err).To(MatchError(HaveSuffix(" invalid argument")))
+			})
+		})
+	})
+
+	Describe("Reading lists", func() {
+		It("should load as an array of immediate children", func() {
+			Expect(s.ReadList("root/")).To(Equal([]byte("[{\"name\":\"baby\"},{\"name\":\"kid\"}]")))
+		})
+		It("should load empty lists", func() {
+			Expect(s.ReadList("root/child2/nest/")).To(Equal([]byte("[]")))
+		})
+		It("should fail on missing parent records", func() {
+			Expect(s.ReadList("root/child3/nest/")).Error().To(HaveOccurred())
+		})
+	})
+
+	Describe("Listing keys", func() {
+		It("should list subkeys of immediate children", func() {
+			Expect(s.List("root/")).To(Equal([]string{"root/child1", "root/child2"}))
+		})
+		It("should list nested subkeys as trees", func() {
+			Expect(s.Write("root/child1/nest/arm", []byte("\"arm\""))).To(Succeed())
+			Expect(s.List("root/")).To(Equal([]string{"root/child1", "root/child2"}))
+			Expect(s.ListTree("root/", 0)).To(Equal([]string{"root/child1", "root/child1/nest/arm", "root/child2"}))
+			Expect(s.ListTree("root/", 2)).To(Equal([]string{"root/child1", "root/child2"}))
+		})
+		It("should report an error for objects", func() {
+			_, err = s.List("root")
+			Expect(err).To(MatchError(HaveSuffix(" location does not identify a collection")))
+		})
+	})
+
+	Describe("Metadata", func() {
+		It("should use the clock for modification times and versions", func() {
+			start := time.Date(2024, 2, 20, 12, 0, 0, 0, time.UTC)
+			clock := storage.NewManualClock(start)
+			s.SetClock(clock)
+			Expect(s.Write("root/child3", child2)).To(Succeed())
+			meta, err := s.Stat("root/child3")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(meta.Updated.Equal(start)).To(BeTrue())
+			Expect(meta.Size).To(Equal(len(child2)))
+
+			// A stopped clock still gives a newer version
+			Expect(s.Write("root/child3", child1)).To(Succeed())
+			Expect(s.Stat("root/child3")).To(HaveField("Version", BeNumerically(">", meta.Version)))
+		})
+		It("should keep versions increasing across clock changes, deletes and restarts", func() {
+			clock := storage.NewManualClock(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC))
+			s.SetClock(clock)
+			Expect(s.Write("root/child3", child1)).To(Succeed())
+			first, err := s.Stat("root/child3")
+			Expect(err).NotTo(HaveOccurred())
+
+			clock.Set(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+			Expect(s.Write("root/child3", child2)).To(Succeed())
+			second, err := s.Stat("root/child3")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(second.Version).To(BeNumerically(">", first.Version))
+
+			Expect(s.Delete("root/child3")).To(BeTrue())
+			restarted := storage.NewFileStorage(dir)
+			restarted.SetClock(clock)
+			Expect(restarted.Write("root/child3", child1)).To(Succeed())
+			Expect(restarted.Stat("root/child3")).To(HaveField("Version", BeNumerically(">", second.Version)))
+		})
+		It("should keep the creation time across writes and restarts", func() {
+			created := time.Date(2024, 2, 20, 12, 0, 0, 0, time.UTC)
+			clock := storage.NewManualClock(created)
+			s.SetClock(clock)
+			Expect(s.Write("root/child3", child1)).To(Succeed())
+			clock.Advance(time.Hour)
+			Expect(s.Write("root/child3", child2)).To(Succeed())
+
+			meta, err := storage.NewFileStorage(dir).Stat("root/child3")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(meta.Created.Equal(created)).To(BeTrue())
+			Expect(meta.Updated.Equal(clock.Now())).To(BeTrue())
+		})
+		It("should fail for missing objects", func() {
+			_, err = s.Stat("missing")
+			Expect(storage.IsObjectNotFound(err)).To(BeTrue())
+		})
+	})
+
+	Describe("Conditional writes", func() {
+		It("should write and delete only if the version matches", func() {
+			meta, err := s.Stat("root/child1")
+			Expect(err).NotTo(HaveOccurred())
+			err = s.WriteIf("root/child1", child2, 0)
+			Expect(storage.IsVersionConflict(err)).To(BeTrue())
+			Expect(s.WriteIf("root/child1", child2, meta.Version)).To(Succeed())
+			err = s.DeleteIf("root/child1", meta.Version)
+			Expect(storage.IsVersionConflict(err)).To(BeTrue())
+			Expect(s.WriteIf("root/child3", child1, 0)).To(Succeed())
+			Expect(s.Read("root/child3")).To(Equal(child1))
+		})
+	})
+
+	Describe("Transactions", func() {
+		It("should apply every change", func() {
+			err = s.Update(func(tx storage.RWCache) error {
+				Expect(tx.Write("root/child3", child1)).To(Succeed())
+				Expect(tx.Delete("root/child1")).To(BeTrue())
+				Expect(tx.List("root/")).To(Equal([]string{"root/child2", "root/child3"}))
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(s.List("root/")).To(Equal([]string{"root/child2", "root/child3"}))
+			Expect(storage.NewFileStorage(dir).Read("root/child3")).To(Equal(child1))
+		})
+		It("should apply nothing if another writer changed the same objects", func() {
+			err = s.Update(func(tx storage.RWCache) error {
+				Expect(tx.Write("root/child3", child1)).To(Succeed())
+				Expect(tx.Write("root/child1", child2)).To(Succeed())
+				Expect(s.Delete("root/child1")).To(BeTrue())
+				return nil
+			})
+			Expect(storage.IsVersionConflict(err)).To(BeTrue())
+			Expect(s.Exists("root/child3")).To(BeFalse())
+		})
+		It("should undo every change if one fails", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			events := s.Watch(ctx, "root/")
+
+			// The last change fails once it is applied, since its directory cannot be created
+			Expect(os.Symlink(filepath.Join(dir, "missing"), filepath.Join(dir, "root", "dangling"))).To(Succeed())
+			err = s.Update(func(tx storage.RWCache) error {
+				Expect(tx.Delete("root/child1")).To(BeTrue())
+				Expect(tx.Write("root/child2", child1)).To(Succeed())
+				Expect(tx.Write("root/child3", child1)).To(Succeed())
+				return tx.Write("root/dangling/child4", child1)
+			})
+			Expect(err).To(MatchError(HavePrefix("root/dangling/child4: ")))
+			Expect(s.Read("root/child1")).To(Equal(child1))
+			Expect(s.Read("root/child2")).To(Equal(child2))
+			Expect(s.Exists("root/child3")).To(BeFalse())
+			Expect(storage.NewFileStorage(dir).List("root/")).To(Equal([]string{"root/child1", "root/child2"}))
+
+			// Nothing is reported for the changes that were undone
+			Expect(s.Delete("root/child2")).To(BeTrue())
+			var e storage.Event
+			Eventually(events).Should(Receive(&e))
+			Expect(e).To(Equal(storage.Event{Type: storage.EventDeleted, Location: "root/child2"}))
+		})
+		It("should report changes once they are all applied", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			events := s.Watch(ctx, "root/")
+
+			err = s.Update(func(tx storage.RWCache) error {
+				Expect(tx.Delete("root/child1")).To(BeTrue())
+				return tx.Write("root/child3", child1)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			var e storage.Event
+			Eventually(events).Should(Receive(&e))
+			Expect(e).To(Equal(storage.Event{Type: storage.EventDeleted, Location: "root/child1"}))
+			Eventually(events).Should(Receive(&e))
+			Expect(e.Type).To(Equal(storage.EventCreated))
+			Expect(e.Location).To(Equal("root/child3"))
+		})
+	})
+
+	Describe("Watching", func() {
+		It("should report changes", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			events := s.Watch(ctx, "root/")
+
+			Expect(s.Write("root/child3", child1)).To(Succeed())
+			Expect(s.Delete("root/child1")).To(BeTrue())
+			meta, err := s.Stat("root/child3")
+			Expect(err).NotTo(HaveOccurred())
+
+			var e storage.Event
+			Eventually(events).Should(Receive(&e))
+			Expect(e).To(Equal(storage.Event{Type: storage.EventCreated, Location: "root/child3", Data: child1, Version: meta.Version}))
+			Eventually(events).Should(Receive(&e))
+			Expect(e).To(Equal(storage.Event{Type: storage.EventDeleted, Location: "root/child1"}))
+		})
+	})
+
+	Describe("Paging lists", func() {
+		It("should read pages by token and limit", func() {
+			page, err := s.ReadPage("root/", storage.PageOptions{Limit: 1})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(page.Data).To(Equal([]byte("[" + string(child1) + "]")))
+			page, err = s.ReadPage("root/", storage.PageOptions{Token: page.Next, Limit: 1})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(page.Data).To(Equal([]byte("[" + string(child2) + "]")))
+			Expect(page.Next).To(BeEmpty())
+		})
+	})
+
+	Describe("Writing locations", func() {
+		It("should store JSON files", func() {
+			Expect(os.ReadFile(filepath.Join(dir, "root", "child1.json"))).To(Equal(child1))
+		})
+		It("should not leave temporary files behind", func() {
+			Expect(s.Write("root/child1", child2)).To(Succeed())
+			Expect(filepath.Glob(filepath.Join(dir, "root", ".*.tmp"))).To(BeEmpty())
+		})
+		It("should be listable", func() {
+			Expect(s.Write("root/other", []byte("\"guy\""))).To(Succeed())
+			Expect(s.List("root/")).To(Equal([]string{"root/child1", "root/child2", "root/other"}))
+			Expect(s.ReadList("root/")).To(Equal([]byte("[{\"name\":\"baby\"},{\"name\":\"kid\"},\"guy\"]")))
+		})
+		It("should report an error for lists", func() {
+			err = s.Write("root/", []byte("\"a\""))
+			Expect(err).To(MatchError(HaveSuffix(" location does not identify an object")))
+		})
+	})
+
+	Describe("Deleting locations", func() {
+		It("should remove the file", func() {
+			Expect(s.Delete("root/child1")).To(BeTrue())
+			Expect(s.Exists("root/child1")).To(BeFalse())
+			Expect(filepath.Join(dir, "root", "child1.json")).NotTo(BeAnExistingFile())
+			Expect(s.List("root/")).To(Equal([]string{"root/child2"}))
+		})
+		It("should fail for missing objects", func() {
+			Expect(s.Delete("missing")).To(BeFalse())
+		})
+		It("should fail for lists", func() {
+			Expect(s.Delete("root/")).To(BeFalse())
+		})
+	})
+
+	Describe("Deleting trees", func() {
+		BeforeEach(func() {
+			Expect(s.Write("root/child1/nest/arm", []byte("\"arm\""))).To(Succeed())
+		})
+
+		It("should remove the file and its directory", func() {
+			Expect(s.List("root/child1/nest/")).To(HaveLen(1))
+			Expect(s.DeleteTree("root/child1")).To(BeTrue())
+			Expect(s.Exists("root/child1/nest/arm")).To(BeFalse())
+			Expect(filepath.Join(dir, "root", "child1.json")).NotTo(BeAnExistingFile())
+			Expect(filepath.Join(dir, "root", "child1")).NotTo(BeADirectory())
+			Expect(s.List("root/")).To(Equal([]string{"root/child2"}))
+		})
+		It("should keep the object when deleting a prefix", func() {
+			Expect(s.DeleteTree("root/child1/")).To(BeTrue())
+			Expect(s.Exists("root/child1")).To(BeTrue())
+			Expect(s.List("root/child1/")).To(BeEmpty())
+		})
+		It("should fail for missing trees", func() {
+			Expect(s.DeleteTree("missing")).To(BeFalse())
+		})
+		It("should report every object it removed", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			events := s.Watch(ctx, "")
+
+			Expect(s.DeleteTree("missing/deeper")).To(BeFalse())
+			Expect(s.DeleteTree("root/child1")).To(BeTrue())
+			var e storage.Event
+			Eventually(events).Should(Receive(&e))
+			Expect(e).To(Equal(storage.Event{Type: storage.EventDeleted, Location: "root/child1/nest/arm"}))
+			Eventually(events).Should(Receive(&e))
+			Expect(e).To(Equal(storage.Event{Type: storage.EventDeleted, Location: "root/child1"}))
+			Consistently(events).ShouldNot(Receive())
+		})
+	})
+
+	Describe("Restarting", func() {
+		It("should keep every object", func() {
+			restarted := storage.NewFileStorage(dir)
+			Expect(restarted.Read("root/child2")).To(Equal(child2))
+			Expect(restarted.ReadList("root/")).To(Equal([]byte("[{\"name\":\"baby\"},{\"name\":\"kid\"}]")))
+		})
+		It("should be readable as fixtures", func() {
+			fixtures := storage.NewFixtureStorage(dir)
+			Expect(fixtures.ReadList("root/")).To(Equal([]byte("[{\"name\":\"baby\"},{\"name\":\"kid\"}]")))
+		})
+	})
+
+	Describe("Resetting", func() {
+		It("should remove every object, but keep counting versions", func() {
+			meta, err := s.Stat("root/child1")
+			Expect(err).NotTo(HaveOccurred())
+			s.Reset()
+			Expect(s.Exists("root")).To(BeFalse())
+			Expect(os.ReadDir(dir)).To(HaveExactElements(HaveField("Name()", ".version")))
+
+			Expect(s.Write("root/child1", child1)).To(Succeed())
+			Expect(s.Stat("root/child1")).To(HaveField("Version", BeNumerically(">", meta.Version)))
+		})
+	})
+})
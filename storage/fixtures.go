@@ -2,101 +2,300 @@ package storage
 
 import (
 	"bytes"
+	"errors"
+	"io/fs"
 	"os"
 	"path"
+	"slices"
 	"strings"
+	"sync"
 )
 
+// FixtureStorage serves read-only objects from files in a file system.  Each object is kept
+// in a "<location>.json", "<location>.yaml" or "<location>.yml" file, or in a collection file
+// holding many objects.  Collection files are named "<collection>.collection.json" (or .yaml
+// or .yml) and contain either an object mapping ids to objects, or an array of objects
+// identified by their IDField.  A "<collection>.jsonl" file holds one such object per line.
+// Every object is normalized to JSON.
 type FixtureStorage struct {
-	Dir   string
-	cache map[string]record
+	Dir         string
+	IDField     string
+	fsys        fs.FS
+	mu          sync.RWMutex
+	cache       map[string]record
+	collections map[string]map[string][]byte
 }
 
+// NewFixtureStorage serves fixtures from a directory on the OS file system.
 func NewFixtureStorage(dir string) *FixtureStorage {
+	f := NewFixtureFS(os.DirFS(dir))
+	f.Dir = dir
+	return f
+}
+
+// NewFixtureFS serves fixtures from any fs.FS, such as an embed.FS, an fstest.MapFS or
+// a zip.Reader.  Locations are resolved relative to the root of fsys.
+func NewFixtureFS(fsys fs.FS) *FixtureStorage {
 	return &FixtureStorage{
-		Dir:   dir,
-		cache: map[string]record{},
+		IDField:     DefaultIDField,
+		fsys:        fsys,
+		cache:       map[string]record{},
+		collections: map[string]map[string][]byte{},
 	}
 }
 
 func (f *FixtureStorage) Clear() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	f.cache = map[string]record{}
+	f.collections = map[string]map[string][]byte{}
 }
 
 func (f *FixtureStorage) Reset() {
 	// NO-OP: read-only storage
 }
 
+// lookup returns a cached record.  Fixtures are read-only, so any record computed
+// outside the lock is still valid when it is stored.
+func (f *FixtureStorage) lookup(location string) (r record, ok bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	r, ok = f.cache[location]
+	return
+}
+
+func (f *FixtureStorage) store(location string, r record) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.cache[location] = r
+}
+
+// collection returns the objects in any collection files for a directory, keyed by id.
+// It returns a nil map if there are no such files.
+func (f *FixtureStorage) collection(dir string) (map[string][]byte, error) {
+	if dir == "" || dir == "." {
+		return nil, nil
+	}
+
+	f.mu.RLock()
+	objects, ok := f.collections[dir]
+	f.mu.RUnlock()
+	if ok {
+		return objects, nil
+	}
+
+	for _, format := range collectionFormats {
+		data, err := fs.ReadFile(f.fsys, dir+format.ext)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, wrapFailure(err, dir+"/")
+		}
+
+		found, err := format.decode(data, f.IDField)
+		if err != nil {
+			return nil, wrapFailure(err, dir+format.ext)
+		}
+		if objects == nil {
+			objects = found
+		} else {
+			for id, object := range found {
+				objects[id] = object
+			}
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.collections[dir] = objects
+	return objects, nil
+}
+
 func (f *FixtureStorage) Read(location string) ([]byte, error) {
 	if strings.HasSuffix(location, "/") {
 		return nil, newError(location, ErrLocationNotObject)
 	}
 
-	if r, ok := f.cache[location]; ok {
+	if r, ok := f.lookup(location); ok {
 		if r.kind() != kindObject {
 			return nil, newError(location, ErrKindNotObject)
 		}
 		return r.(objectRecord).data, nil
 	}
 
-	path := path.Join(f.Dir, location) + ".json"
-	buff, err := os.ReadFile(path)
+	// Try each object file format in turn, remembering why the first one was missing.
+	var missing error
+	for _, format := range objectFormats {
+		buff, err := fs.ReadFile(f.fsys, location+format.ext)
+		if errors.Is(err, fs.ErrNotExist) {
+			if missing == nil {
+				missing = err
+			}
+			continue
+		} else if err == nil && format.decode != nil {
+			buff, err = format.decode(buff)
+		}
+		if err != nil {
+			return nil, wrapFailure(err, location)
+		}
+
+		// cache the result and return it
+		f.store(location, objectRecord{data: buff})
+		return buff, nil
+	}
+
+	// Fall back to any collection file holding the object.
+	dir, id := path.Split(location)
+	objects, err := f.collection(path.Clean(dir))
 	if err != nil {
-		return nil, wrapFailure(err, location)
+		return nil, err
+	} else if buff, ok := objects[id]; ok {
+		f.store(location, objectRecord{data: buff})
+		return buff, nil
 	}
+	return nil, wrapError(missing, location, ErrObjectNotFound)
+}
 
-	// cache the result and return it
-	f.cache[location] = objectRecord{data: buff}
-	return buff, nil
+// Stat describes a fixture using the modification time of the file holding it, for both its
+// creation and update times, since fixtures are never written.  Every fixture has version 1.
+func (f *FixtureStorage) Stat(location string) (Metadata, error) {
+	data, err := f.Read(location)
+	if err != nil {
+		return Metadata{}, err
+	}
+	info, err := f.file(location)
+	if err != nil {
+		return Metadata{}, wrapFailure(err, location)
+	}
+	return fileMetadata(location, len(data), info), nil
+}
+
+// file describes the file holding a fixture, which may be a collection file.
+func (f *FixtureStorage) file(location string) (fs.FileInfo, error) {
+	for _, format := range objectFormats {
+		if info, err := fs.Stat(f.fsys, location+format.ext); err == nil {
+			return info, nil
+		}
+	}
+	dir := path.Dir(location)
+	for _, format := range collectionFormats {
+		if info, err := fs.Stat(f.fsys, dir+format.ext); err == nil {
+			return info, nil
+		}
+	}
+	return nil, fs.ErrNotExist
+}
+
+// fileMetadata describes an object kept in a file that was never written by a store, using
+// the file's modification time for both its creation and update times.  Every such object
+// has version 1, so that objects written over it by a store only need a version above 1.
+func fileMetadata(location string, size int, info fs.FileInfo) Metadata {
+	modified := info.ModTime()
+	return Metadata{
+		Location: location,
+		Version:  1,
+		Size:     size,
+		Created:  modified,
+		Updated:  modified,
+	}
 }
 
 func (f *FixtureStorage) Exists(location string) bool {
-	if r, ok := f.cache[location]; ok {
+	if r, ok := f.lookup(location); ok {
 		return r.kind() == kindObject
 	} else if strings.HasSuffix(location, "/") {
 		return false
-	} else {
-		path := path.Join(f.Dir, location) + ".json"
-		_, err := os.Stat(path)
-		return err == nil
 	}
+
+	for _, format := range objectFormats {
+		if _, err := fs.Stat(f.fsys, location+format.ext); err == nil {
+			return true
+		}
+	}
+	dir, id := path.Split(location)
+	objects, _ := f.collection(path.Clean(dir))
+	_, ok := objects[id]
+	return ok
 }
 
 func (f *FixtureStorage) List(location string) ([]string, error) {
-	subdir, has := strings.CutSuffix(location, "/")
-	if !has {
+	if !strings.HasSuffix(location, "/") {
 		return nil, newError(location, ErrLocationNotPrefix)
 	}
 
 	// Return the data if it is cached
-	if r, ok := f.cache[location]; ok {
+	if r, ok := f.lookup(location); ok {
 		if r.kind() != kindCollection {
 			return nil, newError(location, ErrKindNotPrefix)
 		}
 		return r.(collectionRecord).subkeys, nil
 	}
 
-	// List files
-	dir := path.Join(f.Dir, subdir)
-	files, err := os.ReadDir(dir)
-	if os.IsNotExist(err) {
-		return nil, wrapError(err, location, ErrPrefixNotFound)
-	} else if err != nil {
-		return nil, wrapFailure(err, location)
+	subkeys, _, err := f.children(location)
+	if err != nil {
+		return nil, err
+	}
+
+	// cache the result and return it
+	f.store(location, collectionRecord{subkeys: subkeys})
+	return subkeys, nil
+}
+
+func (f *FixtureStorage) ListTree(location string, depth int) ([]string, error) {
+	if location != "" && !strings.HasSuffix(location, "/") {
+		return nil, newError(location, ErrLocationNotPrefix)
+	} else if depth == 1 && location != "" {
+		return f.List(location)
+	}
+	return listTree(location, depth, f.children)
+}
+
+// children lists the objects directly beneath a prefix, along with the nested prefixes of
+// any directories or collection files beneath it.
+func (f *FixtureStorage) children(location string) (subkeys, prefixes []string, err error) {
+	// List files, and any collection files for the same directory
+	subdir, _ := strings.CutSuffix(location, "/")
+	if subdir == "" {
+		subdir = "."
+	}
+	files, err := fs.ReadDir(f.fsys, subdir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, wrapFailure(err, location)
+	}
+	objects, cerr := f.collection(subdir)
+	if cerr != nil {
+		return nil, nil, cerr
+	} else if err != nil && objects == nil {
+		return nil, nil, wrapError(err, location, ErrPrefixNotFound)
 	}
 
-	// Cache the list of JSON files
-	subkeys := make([]string, 0, len(files))
+	subkeys = make([]string, 0, len(files)+len(objects))
 	for i := range files {
 		name := files[i].Name()
-		if basename, has := strings.CutSuffix(name, ".json"); has {
+		if files[i].IsDir() {
+			prefixes = append(prefixes, path.Join(location, name)+"/")
+		} else if basename, coll, ok := fixtureName(name); !ok {
+			continue
+		} else if coll {
+			prefixes = append(prefixes, path.Join(location, basename)+"/")
+		} else {
 			subkeys = append(subkeys, path.Join(location, basename))
 		}
 	}
+	for id := range objects {
+		subkeys = append(subkeys, path.Join(location, id))
+	}
+	slices.Sort(subkeys)
+	slices.Sort(prefixes)
+	return slices.Compact(subkeys), slices.Compact(prefixes), nil
+}
 
-	// cache the result and return it
-	f.cache[location] = collectionRecord{subkeys: subkeys}
-	return subkeys, nil
+func (f *FixtureStorage) ReadPage(location string, options PageOptions) (*Page, error) {
+	subkeys, err := f.List(location)
+	if err != nil {
+		return nil, err
+	}
+	return readPage(location, subkeys, options, f.Read)
 }
 
 func (f *FixtureStorage) ReadList(location string) ([]byte, error) {
@@ -108,7 +307,7 @@ func (f *FixtureStorage) ReadList(location string) ([]byte, error) {
 	// Hydrate the file list if the data is not cached.
 	var subkeys []string
 	var err error
-	if r, ok := f.cache[location]; !ok {
+	if r, ok := f.lookup(location); !ok {
 		subkeys, err = f.List(location)
 		if err != nil {
 			return nil, err
@@ -138,6 +337,6 @@ func (f *FixtureStorage) ReadList(location string) ([]byte, error) {
 
 	// Cache the result and return it
 	b := buff.Bytes()
-	f.cache[location] = collectionRecord{data: b, subkeys: subkeys}
+	f.store(location, collectionRecord{data: b, subkeys: subkeys})
 	return b, nil
 }
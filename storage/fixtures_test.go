@@ -1,8 +1,12 @@
 package storage_test
 
 import (
+	"io/fs"
 	"os"
 	"path"
+	"sync"
+	"testing/fstest"
+	"time"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
@@ -99,5 +103,203 @@ var _ = Describe("FixtureStorage", func() {
 				Expect(f.List("root/child3/nest/")).Error().To(HaveOccurred())
 			})
 		})
+
+		Context("that are trees", func() {
+			It("should list nested subkeys at any depth", func() {
+				Expect(f.ListTree("root/", 0)).To(Equal([]string{
+					"root/child1", "root/child1/nest/arm", "root/child1/nest/leg", "root/child2"}))
+			})
+			It("should limit the depth", func() {
+				Expect(f.ListTree("root/", 1)).To(Equal([]string{"root/child1", "root/child2"}))
+				Expect(f.ListTree("root/", 2)).To(Equal([]string{"root/child1", "root/child2"}))
+				Expect(f.ListTree("root/child1/", 2)).To(Equal([]string{"root/child1/nest/arm", "root/child1/nest/leg"}))
+			})
+			It("should fail on missing directories", func() {
+				Expect(f.ListTree("root/child3/", 0)).Error().To(HaveOccurred())
+			})
+		})
+	})
+
+	Describe("Paging fixture lists", func() {
+		It("should read pages by offset and limit", func() {
+			page, err := f.ReadPage("root/", storage.PageOptions{Offset: 1, Limit: 1})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(page.Keys).To(Equal([]string{"root/child2"}))
+			Expect(page.Data).To(Equal([]byte("[" + string(child2) + "]")))
+			Expect(page.Next).To(BeEmpty())
+		})
+		It("should fail on missing directories", func() {
+			Expect(f.ReadPage("root/child3/", storage.PageOptions{})).Error().To(HaveOccurred())
+		})
+	})
+
+	Describe("Concurrent access", func() {
+		It("should be safe for parallel readers", func() {
+			var wg sync.WaitGroup
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					defer GinkgoRecover()
+					for j := 0; j < 100; j++ {
+						Expect(f.Read("root/child1")).To(Equal(child1))
+						Expect(f.Exists("root/child2")).To(BeTrue())
+						Expect(f.List("root/")).To(Equal([]string{"root/child1", "root/child2"}))
+						Expect(f.ReadList("root/child1/nest/")).To(ContainSubstring("\"arm\""))
+						if j%10 == 0 {
+							c.Clear()
+						}
+					}
+				}()
+			}
+			wg.Wait()
+		})
+	})
+})
+
+var _ = Describe("FixtureStorage backed by an fs.FS", func() {
+	sources := []struct {
+		name string
+		fsys fs.FS
+	}{
+		{"embed.FS", test.FixtureFS()},
+		{"fstest.MapFS", fstest.MapFS{
+			"root.json":                 &fstest.MapFile{Data: []byte("{\"name\":\"root\"}")},
+			"root/child1.json":          &fstest.MapFile{Data: []byte("{\"name\":\"baby\"}")},
+			"root/child2.json":          &fstest.MapFile{Data: []byte("{\"name\":\"kid\"}")},
+			"root/child1/nest/arm.json": &fstest.MapFile{Data: []byte("{\"limb\":\"arm\", \"side\":\"right\"}")},
+			"root/child1/nest/leg.json": &fstest.MapFile{Data: []byte("{\"limb\":\"leg\", \"side\":\"left\"}")},
+			"root/child2/nest/.keep":    &fstest.MapFile{},
+		}},
+	}
+
+	for _, source := range sources {
+		f := storage.NewFixtureFS(source.fsys)
+		var c storage.RCache = f // force breakage if we fail to implement the interface
+
+		Context(source.name, func() {
+			BeforeEach(func() { c.Clear() })
+
+			It("should read objects", func() {
+				Expect(f.Read("root")).To(Equal([]byte("{\"name\":\"root\"}")))
+				Expect(f.Read("root/child1/nest/arm")).To(Equal([]byte("{\"limb\":\"arm\", \"side\":\"right\"}")))
+				Expect(f.Exists("root/child2")).To(BeTrue())
+			})
+			It("should report missing objects", func() {
+				Expect(f.Read("missing")).Error().To(MatchError(HaveSuffix(" file does not exist")))
+				_, err := f.Read("missing")
+				Expect(storage.IsObjectNotFound(err)).To(BeTrue())
+				Expect(f.Exists("missing")).To(BeFalse())
+			})
+			It("should list immediate children", func() {
+				Expect(f.List("root/")).To(Equal([]string{"root/child1", "root/child2"}))
+				Expect(f.List("root/child2/nest/")).To(Equal([]string{}))
+			})
+			It("should fail on missing directories", func() {
+				_, err := f.List("root/child3/nest/")
+				Expect(storage.IsPrefixNotFound(err)).To(BeTrue())
+			})
+			It("should load lists as JSON arrays", func() {
+				Expect(f.ReadList("root/")).To(Equal([]byte("[{\"name\":\"baby\"},{\"name\":\"kid\"}]")))
+			})
+		})
+	}
+})
+
+var _ = Describe("FixtureStorage with mixed file formats", func() {
+	f := storage.NewFixtureFS(fstest.MapFS{
+		"root.yaml":                  &fstest.MapFile{Data: []byte("# the root of all fixtures\nname: root\n")},
+		"root/child1.json":           &fstest.MapFile{Data: []byte("{\"name\":\"baby\"}")},
+		"root/child2.yml":            &fstest.MapFile{Data: []byte("name: kid\nages: [3, 4]\n")},
+		"root/child1/nest.jsonl":     &fstest.MapFile{Data: []byte("{\"id\":\"leg\",\"side\":\"left\"}\n\n{\"id\":\"arm\",\"side\":\"right\"}\n")},
+		"root/child2/nest/hand.yaml": &fstest.MapFile{Data: []byte("id: hand\nfingers:\n  1: thumb\n")},
+		"root/child3/nest.jsonl":     &fstest.MapFile{Data: []byte("{\"side\":\"left\"}\n")},
+	})
+
+	BeforeEach(func() { f.Clear() })
+
+	It("should normalize YAML to JSON", func() {
+		Expect(f.Read("root")).To(Equal([]byte("{\"name\":\"root\"}")))
+		Expect(f.Read("root/child2")).To(Equal([]byte("{\"ages\":[3,4],\"name\":\"kid\"}")))
+		Expect(f.Read("root/child2/nest/hand")).To(Equal([]byte("{\"fingers\":{\"1\":\"thumb\"},\"id\":\"hand\"}")))
+	})
+	It("should read JSON lines by id", func() {
+		Expect(f.Read("root/child1/nest/arm")).To(Equal([]byte("{\"id\":\"arm\",\"side\":\"right\"}")))
+		Expect(f.Exists("root/child1/nest/leg")).To(BeTrue())
+		Expect(f.Exists("root/child1/nest/foot")).To(BeFalse())
+		_, err := f.Read("root/child1/nest/foot")
+		Expect(storage.IsObjectNotFound(err)).To(BeTrue())
+	})
+	It("should list every format", func() {
+		Expect(f.List("root/")).To(Equal([]string{"root/child1", "root/child2"}))
+		Expect(f.List("root/child1/nest/")).To(Equal([]string{"root/child1/nest/arm", "root/child1/nest/leg"}))
+		Expect(f.List("root/child2/nest/")).To(Equal([]string{"root/child2/nest/hand"}))
+	})
+	It("should read lists of every format", func() {
+		Expect(f.ReadList("root/")).To(Equal([]byte("[{\"name\":\"baby\"},{\"ages\":[3,4],\"name\":\"kid\"}]")))
+		Expect(f.ReadList("root/child1/nest/")).To(Equal([]byte("[{\"id\":\"arm\",\"side\":\"right\"},{\"id\":\"leg\",\"side\":\"left\"}]")))
+	})
+	It("should fail on JSON lines without ids", func() {
+		Expect(f.List("root/child3/nest/")).Error().To(MatchError(ContainSubstring("line 1: \"id\" is not a valid id field")))
+	})
+})
+
+var _ = Describe("FixtureStorage with collection files", func() {
+	modified := time.Date(2024, 2, 20, 12, 0, 0, 0, time.UTC)
+	files := storage.NewFixtureStorage(test.FixtureDir())
+	f := storage.NewFixtureFS(fstest.MapFS{
+		"root.json": &fstest.MapFile{Data: []byte("{\"name\":\"root\"}")},
+		"root.collection.json": &fstest.MapFile{Data: []byte(`{
+			"child1": {"name": "baby"},
+			"child2": {"name": "kid"}
+		}`)},
+		"root/child1/nest.collection.yaml": &fstest.MapFile{ModTime: modified, Data: []byte(
+			"- {limb: leg, side: left}\n- {limb: arm, side: right}\n")},
+		"root/child2/nest.collection.json": &fstest.MapFile{Data: []byte("[]")},
+		"root/child3/nest.collection.json": &fstest.MapFile{Data: []byte("[{\"name\":\"toe\"}]")},
+	})
+
+	BeforeEach(func() {
+		files.Clear()
+		f.Clear()
+		f.IDField = "limb"
+	})
+
+	It("should read objects mapped by id", func() {
+		Expect(f.Read("root/child1")).To(Equal([]byte("{\"name\":\"baby\"}")))
+		Expect(f.Exists("root/child2")).To(BeTrue())
+		Expect(f.Exists("root/child3")).To(BeFalse())
+	})
+	It("should read objects identified by the id field", func() {
+		Expect(f.Read("root/child1/nest/arm")).To(Equal([]byte("{\"limb\":\"arm\",\"side\":\"right\"}")))
+		Expect(f.Exists("root/child1/nest/leg")).To(BeTrue())
+	})
+	It("should describe objects by their collection file", func() {
+		meta, err := f.Stat("root/child1/nest/arm")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(meta.Updated).To(Equal(modified))
+		Expect(meta.Version).To(Equal(uint64(1)))
+		Expect(meta.Size).To(Equal(len("{\"limb\":\"arm\",\"side\":\"right\"}")))
+	})
+	It("should list the same keys as per-file fixtures", func() {
+		for _, location := range []string{"root/", "root/child1/nest/", "root/child2/nest/"} {
+			expected, err := files.List(location)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(f.List(location)).To(Equal(expected))
+		}
+	})
+	It("should list the same trees as per-file fixtures", func() {
+		expected, err := files.ListTree("root/child1/", 0)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(f.ListTree("root/child1/", 0)).To(Equal(expected))
+	})
+	It("should read lists like per-file fixtures", func() {
+		expected, err := files.ReadList("root/")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(f.ReadList("root/")).To(Equal(expected))
+		Expect(f.ReadList("root/child2/nest/")).To(Equal([]byte("[]")))
+	})
+	It("should fail on objects without ids", func() {
+		Expect(f.List("root/child3/nest/")).Error().To(MatchError(ContainSubstring("item 0: \"limb\" is not a valid id field")))
 	})
 })
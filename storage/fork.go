@@ -0,0 +1,11 @@
+package storage
+
+import "errors"
+
+var ErrForksUnsupported = errors.New("storage: forks are not supported")
+
+// Forker is implemented by stores that can fork a copy-on-write copy of themselves, which
+// starts with the same contents but is isolated from any writes to the original afterwards.
+type Forker interface {
+	Fork() (RWCache, error)
+}
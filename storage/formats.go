@@ -0,0 +1,179 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultIDField is the field used to identify objects kept in collection files.
+const DefaultIDField = "id"
+
+type objectFormat struct {
+	ext    string
+	decode func(data []byte) ([]byte, error)
+}
+
+type collectionFormat struct {
+	ext    string
+	decode func(data []byte, idField string) (map[string][]byte, error)
+}
+
+var (
+	// objectFormats hold a single object per file, in order of precedence.
+	objectFormats = []objectFormat{
+		{".json", nil},
+		{".yaml", yamlToJSON},
+		{".yml", yamlToJSON},
+	}
+
+	// collectionFormats hold every object in a collection in a single file.
+	collectionFormats = []collectionFormat{
+		{".collection.json", decodeCollection},
+		{".collection.yaml", decodeYAMLCollection},
+		{".collection.yml", decodeYAMLCollection},
+		{".jsonl", decodeJSONLines},
+	}
+)
+
+// fixtureName classifies a file name, returning its basename without the extension.
+func fixtureName(name string) (basename string, collection bool, ok bool) {
+	for _, format := range collectionFormats {
+		if basename, ok = strings.CutSuffix(name, format.ext); ok && basename != "" {
+			return basename, true, true
+		}
+	}
+	for _, format := range objectFormats {
+		if basename, ok = strings.CutSuffix(name, format.ext); ok && basename != "" {
+			return basename, false, true
+		}
+	}
+	return "", false, false
+}
+
+func yamlToJSON(data []byte) ([]byte, error) {
+	var value any
+	if err := yaml.Unmarshal(data, &value); err != nil {
+		return nil, err
+	}
+	return json.Marshal(jsonValue(value))
+}
+
+// jsonValue converts any maps with non-string keys, which YAML allows, so they can be marshalled as JSON.
+func jsonValue(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		for k, e := range v {
+			v[k] = jsonValue(e)
+		}
+	case map[any]any:
+		m := make(map[string]any, len(v))
+		for k, e := range v {
+			m[fmt.Sprint(k)] = jsonValue(e)
+		}
+		return m
+	case []any:
+		for i, e := range v {
+			v[i] = jsonValue(e)
+		}
+	}
+	return value
+}
+
+func decodeJSONLines(data []byte, idField string) (map[string][]byte, error) {
+	objects := map[string][]byte{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, len(data)+1)
+	for n := 1; scanner.Scan(); n++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		id, err := objectID(line, idField)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		objects[id] = bytes.Clone(line)
+	}
+	return objects, scanner.Err()
+}
+
+// decodeCollection decodes either an object mapping ids to objects, or an array of
+// objects that are identified by their idField.
+func decodeCollection(data []byte, idField string) (map[string][]byte, error) {
+	objects := map[string][]byte{}
+	data = bytes.TrimSpace(data)
+	if bytes.HasPrefix(data, []byte("[")) {
+		var items []json.RawMessage
+		if err := json.Unmarshal(data, &items); err != nil {
+			return nil, err
+		}
+		for i, item := range items {
+			id, err := objectID(item, idField)
+			if err != nil {
+				return nil, fmt.Errorf("item %d: %w", i, err)
+			}
+			objects[id] = item
+		}
+	} else {
+		var items map[string]json.RawMessage
+		if err := json.Unmarshal(data, &items); err != nil {
+			return nil, err
+		}
+		for id, item := range items {
+			if id == "" || strings.Contains(id, "/") {
+				return nil, fmt.Errorf("%q is not a valid id", id)
+			}
+			objects[id] = item
+		}
+	}
+
+	// Compact each object so it is indistinguishable from a single object file.
+	for id, object := range objects {
+		buff := bytes.Buffer{}
+		if err := json.Compact(&buff, object); err != nil {
+			return nil, err
+		}
+		objects[id] = buff.Bytes()
+	}
+	return objects, nil
+}
+
+func decodeYAMLCollection(data []byte, idField string) (map[string][]byte, error) {
+	data, err := yamlToJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	return decodeCollection(data, idField)
+}
+
+// objectID extracts a string or numeric id from a JSON object.
+func objectID(data []byte, idField string) (string, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return "", err
+	}
+	return formatID(fields[idField], idField)
+}
+
+func formatID(raw json.RawMessage, idField string) (string, error) {
+	var id any
+	if raw != nil {
+		if err := json.Unmarshal(raw, &id); err != nil {
+			return "", err
+		}
+	}
+	switch v := id.(type) {
+	case string:
+		if v != "" && !strings.Contains(v, "/") {
+			return v, nil
+		}
+	case float64:
+		return string(raw), nil
+	}
+	return "", fmt.Errorf("%q is not a valid id field", idField)
+}
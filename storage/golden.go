@@ -0,0 +1,155 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+// GoldenOptions controls how CheckGolden compares a store to an expected fixture tree.
+type GoldenOptions struct {
+	// Ignore lists fields to leave out of every object before comparing them, such as
+	// timestamps or generated ids.  Nested fields are given as dotted paths, such as
+	// "meta.updated", and apply to every object in any array along the way.
+	Ignore []string
+	// Update rewrites the expected tree to match the store, instead of comparing them.
+	// Any files already in the directory are removed first.
+	Update bool
+}
+
+// GoldenDiff lists the locations where a store differs from an expected fixture tree.
+type GoldenDiff struct {
+	Dir     string
+	Added   []string
+	Removed []string
+	Changed []string
+}
+
+func (d *GoldenDiff) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: %d differences from the expected fixtures", d.Dir, len(d.Added)+len(d.Removed)+len(d.Changed))
+	for _, diff := range []struct {
+		sign      string
+		locations []string
+	}{{"+", d.Added}, {"-", d.Removed}, {"~", d.Changed}} {
+		for _, location := range diff.locations {
+			fmt.Fprintf(&b, "\n\t%s %s", diff.sign, location)
+		}
+	}
+	return b.String()
+}
+
+// CheckGolden compares every object in a store to the fixtures in a directory, comparing
+// them as JSON, so the order of their keys does not matter.  It returns a *GoldenDiff if
+// any location was added to the store, removed from it, or changed.  A directory that does
+// not exist has no fixtures.
+func CheckGolden(c RCache, dir string, options GoldenOptions) error {
+	if options.Update {
+		return updateGolden(c, dir)
+	}
+
+	actual, err := c.ListTree("", 0)
+	if err != nil && !IsPrefixNotFound(err) {
+		return err
+	}
+	f := NewFixtureStorage(dir)
+	expected, err := f.ListTree("", 0)
+	if err != nil && !IsPrefixNotFound(err) {
+		return err
+	}
+
+	// Merge the sorted lists, comparing the locations in both
+	diff := &GoldenDiff{Dir: dir}
+	for len(actual) > 0 || len(expected) > 0 {
+		switch {
+		case len(expected) == 0 || (len(actual) > 0 && actual[0] < expected[0]):
+			diff.Added = append(diff.Added, actual[0])
+			actual = actual[1:]
+		case len(actual) == 0 || expected[0] < actual[0]:
+			diff.Removed = append(diff.Removed, expected[0])
+			expected = expected[1:]
+		default:
+			location := actual[0]
+			actual, expected = actual[1:], expected[1:]
+			got, err := c.Read(location)
+			if err != nil {
+				return err
+			}
+			want, err := f.Read(location)
+			if err != nil {
+				return err
+			}
+			if !sameJSON(got, want, options.Ignore) {
+				diff.Changed = append(diff.Changed, location)
+			}
+		}
+	}
+
+	if len(diff.Added)+len(diff.Removed)+len(diff.Changed) > 0 {
+		return diff
+	}
+	return nil
+}
+
+// sameJSON compares two objects as JSON, leaving out any ignored fields, or as bytes if
+// either is not valid JSON.
+func sameJSON(a, b []byte, ignore []string) bool {
+	var av, bv any
+	if json.Unmarshal(a, &av) != nil || json.Unmarshal(b, &bv) != nil {
+		return bytes.Equal(a, b)
+	}
+	for _, field := range ignore {
+		path := strings.Split(field, ".")
+		removeField(av, path)
+		removeField(bv, path)
+	}
+	return reflect.DeepEqual(av, bv)
+}
+
+// removeField removes a field from a decoded JSON value, given its path.
+func removeField(v any, path []string) {
+	switch v := v.(type) {
+	case map[string]any:
+		if len(path) == 1 {
+			delete(v, path[0])
+		} else if nested, ok := v[path[0]]; ok {
+			removeField(nested, path[1:])
+		}
+	case []any:
+		for _, element := range v {
+			removeField(element, path)
+		}
+	}
+}
+
+// updateGolden exports a store next to a directory before replacing it, since the store
+// may still be reading fixtures from the directory it replaces.
+func updateGolden(c RCache, dir string) error {
+	parent := filepath.Dir(dir)
+	if err := os.MkdirAll(parent, 0o755); err != nil {
+		return wrapFailure(err, parent)
+	}
+	tmp, err := os.MkdirTemp(parent, "."+filepath.Base(dir)+"-*")
+	if err != nil {
+		return wrapFailure(err, dir)
+	}
+	defer os.RemoveAll(tmp)
+	if err = os.Chmod(tmp, 0o755); err != nil {
+		return wrapFailure(err, tmp)
+	}
+
+	if err = Export(c, tmp, ExportOptions{}); err != nil {
+		return err
+	}
+	if err = os.RemoveAll(dir); err != nil {
+		return wrapFailure(err, dir)
+	}
+	if err = os.Rename(tmp, dir); err != nil {
+		return wrapFailure(err, dir)
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package storage_test
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github/joekhoobyar/epigon/storage"
+	"github/joekhoobyar/epigon/test"
+)
+
+var _ = Describe("CheckGolden", func() {
+	var u *storage.UnionedCache
+
+	BeforeEach(func() {
+		u = storage.NewUnionedCache(test.FixtureDir())
+	})
+
+	It("should match the fixtures a store was loaded from", func() {
+		Expect(storage.CheckGolden(u, test.FixtureDir(), storage.GoldenOptions{})).To(Succeed())
+	})
+
+	It("should ignore the order of keys", func() {
+		Expect(u.Write("root/child1", []byte("{\"name\":\"child1\",\"id\":\"child1\"}"))).To(Succeed())
+		dir := GinkgoT().TempDir()
+		Expect(storage.Export(u, dir, storage.ExportOptions{})).To(Succeed())
+		Expect(u.Write("root/child1", []byte("{ \"id\": \"child1\", \"name\": \"child1\" }"))).To(Succeed())
+		Expect(storage.CheckGolden(u, dir, storage.GoldenOptions{})).To(Succeed())
+	})
+
+	It("should report every added, removed and changed location", func() {
+		Expect(u.Write("root/child3", []byte("{}"))).To(Succeed())
+		Expect(u.Delete("root/child1/nest/arm")).To(BeTrue())
+		Expect(u.Write("root/child2", []byte("{\"name\":\"changed\"}"))).To(Succeed())
+
+		err := storage.CheckGolden(u, test.FixtureDir(), storage.GoldenOptions{})
+		var diff *storage.GoldenDiff
+		Expect(errors.As(err, &diff)).To(BeTrue())
+		Expect(diff.Added).To(Equal([]string{"root/child3"}))
+		Expect(diff.Removed).To(Equal([]string{"root/child1/nest/arm"}))
+		Expect(diff.Changed).To(Equal([]string{"root/child2"}))
+		Expect(err).To(MatchError(HaveSuffix("\n\t+ root/child3\n\t- root/child1/nest/arm\n\t~ root/child2")))
+	})
+
+	It("should ignore volatile fields", func() {
+		dir := GinkgoT().TempDir()
+		Expect(u.Write("root/child3", []byte("{\"meta\":{\"updated\":1},\"items\":[{\"at\":1,\"n\":1}]}"))).To(Succeed())
+		Expect(storage.Export(u, dir, storage.ExportOptions{})).To(Succeed())
+		Expect(u.Write("root/child3", []byte("{\"meta\":{\"updated\":2},\"items\":[{\"at\":2,\"n\":1}]}"))).To(Succeed())
+
+		Expect(storage.CheckGolden(u, dir, storage.GoldenOptions{})).NotTo(Succeed())
+		Expect(storage.CheckGolden(u, dir, storage.GoldenOptions{Ignore: []string{"meta.updated", "items.at"}})).To(Succeed())
+	})
+
+	It("should rewrite the expected fixtures when updating", func() {
+		dir := filepath.Join(GinkgoT().TempDir(), "golden")
+		Expect(storage.CheckGolden(u, dir, storage.GoldenOptions{})).NotTo(Succeed())
+		Expect(storage.CheckGolden(u, dir, storage.GoldenOptions{Update: true})).To(Succeed())
+		Expect(storage.CheckGolden(u, dir, storage.GoldenOptions{})).To(Succeed())
+
+		Expect(u.DeleteTree("root/child1")).To(BeTrue())
+		Expect(storage.CheckGolden(u, dir, storage.GoldenOptions{Update: true})).To(Succeed())
+		Expect(storage.CheckGolden(u, dir, storage.GoldenOptions{})).To(Succeed())
+	})
+
+	It("should update the fixtures a store is reading from", func() {
+		dir := copyFixtures(filepath.Join(GinkgoT().TempDir(), "fixtures"))
+		u = storage.NewUnionedCache(dir)
+		Expect(u.Write("root/child3", []byte("{}"))).To(Succeed())
+		Expect(storage.CheckGolden(u, dir, storage.GoldenOptions{Update: true})).To(Succeed())
+
+		fixtures := storage.NewFixtureStorage(dir)
+		Expect(fixtures.ListTree("", 0)).To(Equal([]string{
+			"root", "root/child1", "root/child1/nest/arm", "root/child1/nest/leg", "root/child2", "root/child3",
+		}))
+		expected, err := os.ReadFile(filepath.Join(test.FixtureDir(), "root", "child1", "nest", "leg.json"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fixtures.Read("root/child1/nest/leg")).To(MatchJSON(expected))
+		Expect(storage.CheckGolden(u, dir, storage.GoldenOptions{})).To(Succeed())
+		Expect(filepath.Glob(filepath.Join(filepath.Dir(dir), ".*"))).To(BeEmpty())
+	})
+})
+
+// copyFixtures copies the test fixtures to a directory, so that tests can change them.
+func copyFixtures(dir string) string {
+	err := filepath.WalkDir(test.FixtureDir(), func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(test.FixtureDir(), name)
+		if entry.IsDir() {
+			return os.MkdirAll(filepath.Join(dir, rel), 0o755)
+		}
+		data, err := os.ReadFile(name)
+		if err == nil {
+			err = os.WriteFile(filepath.Join(dir, rel), data, 0o644)
+		}
+		return err
+	})
+	Expect(err).NotTo(HaveOccurred())
+	return dir
+}
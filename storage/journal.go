@@ -0,0 +1,356 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// JournalOp says which mutation a journal entry records.
+type JournalOp string
+
+const (
+	JournalWrite      JournalOp = "write"
+	JournalWriteTTL   JournalOp = "writeTTL"
+	JournalDelete     JournalOp = "delete"
+	JournalDeleteTree JournalOp = "deleteTree"
+	JournalClear      JournalOp = "clear"
+	JournalReset      JournalOp = "reset"
+)
+
+// JournalEntry records a single mutation, along with when it was made.  Data is only set
+// for writes, and TTL only for writes that expire.
+type JournalEntry struct {
+	Time     time.Time     `json:"time"`
+	Op       JournalOp     `json:"op"`
+	Location string        `json:"location,omitempty"`
+	Data     []byte        `json:"data,omitempty"`
+	TTL      time.Duration `json:"ttl,omitempty"`
+}
+
+// Journal is an append-only log of mutations.
+type Journal interface {
+	Append(entry JournalEntry) error
+	// Entries returns every entry appended so far, in order.
+	Entries() ([]JournalEntry, error)
+}
+
+// MemoryJournal keeps a journal in memory.
+type MemoryJournal struct {
+	mu      sync.Mutex
+	entries []JournalEntry
+}
+
+func NewMemoryJournal() *MemoryJournal {
+	return &MemoryJournal{}
+}
+
+func (j *MemoryJournal) Append(entry JournalEntry) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.entries = append(j.entries, entry)
+	return nil
+}
+
+func (j *MemoryJournal) Entries() ([]JournalEntry, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return append([]JournalEntry(nil), j.entries...), nil
+}
+
+// FileJournal keeps a journal in a file, with one JSON entry per line.  Entries are
+// appended to any already in the file, so a store can be rebuilt from it with Replay
+// before journaling any more mutations to it.
+type FileJournal struct {
+	Name string
+	mu   sync.Mutex
+	file *os.File
+}
+
+// OpenFileJournal opens a journal file for appending, creating it if needed.
+func OpenFileJournal(name string) (*FileJournal, error) {
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileJournal{Name: name, file: file}, nil
+}
+
+func (j *FileJournal) Append(entry JournalEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	_, err = j.file.Write(append(line, '\n'))
+	return err
+}
+
+func (j *FileJournal) Entries() ([]JournalEntry, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	file, err := os.Open(j.Name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []JournalEntry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 64*1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		var entry JournalEntry
+		if err = json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", j.Name, n, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+func (j *FileJournal) Close() error {
+	return j.file.Close()
+}
+
+// Replay applies every entry in a journal to a store, in order.  Objects written with a TTL
+// are written with the same TTL again, which the store must be an Expirer to do.
+func Replay(journal Journal, store RWCache) error {
+	entries, err := journal.Entries()
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		switch entry.Op {
+		case JournalWrite:
+			err = store.Write(entry.Location, entry.Data)
+		case JournalWriteTTL:
+			if expirer, ok := store.(Expirer); ok {
+				err = expirer.WriteTTL(entry.Location, entry.Data, entry.TTL)
+			} else {
+				err = wrapFailure(ErrExpiriesUnsupported, entry.Location)
+			}
+		case JournalDelete:
+			store.Delete(entry.Location)
+		case JournalDeleteTree:
+			store.DeleteTree(entry.Location)
+		case JournalClear:
+			store.Clear()
+		case JournalReset:
+			store.Reset()
+		default:
+			err = wrapFailure(fmt.Errorf("Replay: unknown journal op %q", entry.Op), entry.Location)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// JournaledCache records every mutation made through it in a journal, once it has been
+// applied to a store.  Mutations that fail, or that change nothing, are not recorded.
+// Reads go straight to the store.
+//
+// Transactions, objects that expire and watches are passed on to the store, which fails
+// them if it does not support them.  Forks are not journaled, since nothing written to a
+// fork changes the store.  Snapshots are not supported, since restoring one cannot be
+// journaled.
+type JournaledCache struct {
+	RWCache
+	journal Journal
+	mu      sync.Mutex
+	clock   Clock
+	err     error
+}
+
+func NewJournaledCache(store RWCache, journal Journal) *JournaledCache {
+	return &JournaledCache{RWCache: store, journal: journal, clock: SystemClock}
+}
+
+// SetClock sets the clock used to timestamp journal entries, along with the store's clock,
+// if it has one.
+func (j *JournaledCache) SetClock(clock Clock) {
+	j.mu.Lock()
+	j.clock = clock
+	j.mu.Unlock()
+	if store, ok := j.RWCache.(Clocked); ok {
+		store.SetClock(clock)
+	}
+}
+
+// Err returns the first error from appending to the journal, including any from methods
+// like Delete that cannot return one.
+func (j *JournaledCache) Err() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.err
+}
+
+// record applies a mutation to the store and then appends it to the journal, if it
+// changed anything, while holding the lock, so the journal keeps the same order.
+func (j *JournaledCache) record(op JournalOp, location string, data []byte, apply func() (bool, error)) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if changed, err := apply(); err != nil || !changed {
+		return err
+	}
+	return j.log(JournalEntry{Op: op, Location: location, Data: data})
+}
+
+// log appends entries to the journal, all with the current time.  It must be called with
+// the lock held.
+func (j *JournaledCache) log(entries ...JournalEntry) error {
+	now := j.clock.Now()
+	for _, entry := range entries {
+		entry.Time = now
+		if err := j.journal.Append(entry); err != nil {
+			err = wrapFailure(err, entry.Location)
+			if j.err == nil {
+				j.err = err
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (j *JournaledCache) Clear() {
+	j.record(JournalClear, "", nil, func() (bool, error) { // nolint: see Err
+		j.RWCache.Clear()
+		return true, nil
+	})
+}
+
+func (j *JournaledCache) Reset() {
+	j.record(JournalReset, "", nil, func() (bool, error) { // nolint: see Err
+		j.RWCache.Reset()
+		return true, nil
+	})
+}
+
+func (j *JournaledCache) Write(location string, data []byte) error {
+	return j.record(JournalWrite, location, data, func() (bool, error) {
+		return true, j.RWCache.Write(location, data)
+	})
+}
+
+func (j *JournaledCache) WriteIf(location string, data []byte, version uint64) error {
+	return j.record(JournalWrite, location, data, func() (bool, error) {
+		return true, j.RWCache.WriteIf(location, data, version)
+	})
+}
+
+func (j *JournaledCache) Delete(location string) bool {
+	var ok bool
+	j.record(JournalDelete, location, nil, func() (bool, error) { // nolint: see Err
+		ok = j.RWCache.Delete(location)
+		return ok, nil
+	})
+	return ok
+}
+
+func (j *JournaledCache) DeleteIf(location string, version uint64) error {
+	return j.record(JournalDelete, location, nil, func() (bool, error) {
+		return true, j.RWCache.DeleteIf(location, version)
+	})
+}
+
+func (j *JournaledCache) DeleteTree(location string) bool {
+	var ok bool
+	j.record(JournalDeleteTree, location, nil, func() (bool, error) { // nolint: see Err
+		ok = j.RWCache.DeleteTree(location)
+		return ok, nil
+	})
+	return ok
+}
+
+// WriteTTL records the TTL along with the object, so that Replay writes it with the same TTL.
+func (j *JournaledCache) WriteTTL(location string, data []byte, ttl time.Duration) error {
+	store, ok := j.RWCache.(Expirer)
+	if !ok {
+		return ErrExpiriesUnsupported
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := store.WriteTTL(location, data, ttl); err != nil {
+		return err
+	}
+	return j.log(JournalEntry{Op: JournalWriteTTL, Location: location, Data: data, TTL: ttl})
+}
+
+// Update applies a transaction to the store in a transaction of its own, and then records
+// every change it made, all with the same time.  The store must be a Transactor, so that
+// the journal never records only part of a transaction.
+func (j *JournaledCache) Update(fn func(tx RWCache) error) error {
+	store, ok := j.RWCache.(Transactor)
+	if !ok {
+		return ErrTransactionsUnsupported
+	}
+	return update(j.RWCache, fn, func(changes []change) error {
+		j.mu.Lock()
+		defer j.mu.Unlock()
+
+		var entries []JournalEntry
+		err := store.Update(func(tx RWCache) error {
+			entries = entries[:0]
+			for _, c := range changes {
+				entry, err := applyChange(tx, c)
+				if err != nil {
+					return err
+				} else if entry.Op != "" {
+					entries = append(entries, entry)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return j.log(entries...)
+	})
+}
+
+// applyChange applies a change from a transaction to a store, as long as the object still
+// has the version the transaction started from, and returns the journal entry recording it.
+// Objects that the transaction created and then deleted again need no entry.
+func applyChange(store RWCache, c change) (JournalEntry, error) {
+	var err error
+	switch {
+	case !c.deleted:
+		err = store.WriteIf(c.location, c.data, c.version)
+		return JournalEntry{Op: JournalWrite, Location: c.location, Data: c.data}, err
+	case c.version != 0:
+		if err = store.DeleteIf(c.location, c.version); IsObjectNotFound(err) {
+			err = newError(c.location, ErrVersionConflict)
+		}
+		return JournalEntry{Op: JournalDelete, Location: c.location}, err
+	case store.Exists(c.location):
+		err = newError(c.location, ErrVersionConflict)
+	}
+	return JournalEntry{}, err
+}
+
+// Fork forks the store, without journaling anything written to the fork.
+func (j *JournaledCache) Fork() (RWCache, error) {
+	store, ok := j.RWCache.(Forker)
+	if !ok {
+		return nil, ErrForksUnsupported
+	}
+	return store.Fork()
+}
+
+// Watch watches the store, or closes the channel straight away if it is not a Watcher.
+func (j *JournaledCache) Watch(ctx context.Context, prefix string) <-chan Event {
+	if store, ok := j.RWCache.(Watcher); ok {
+		return store.Watch(ctx, prefix)
+	}
+	return closedEvents()
+}
@@ -0,0 +1,144 @@
+package storage_test
+
+import (
+	"context"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github/joekhoobyar/epigon/storage"
+)
+
+var _ = Describe("JournaledCache", func() {
+	var root, child1, child2 []byte
+	var journal *storage.MemoryJournal
+	var j *storage.JournaledCache
+	var clock *storage.ManualClock
+	start := time.Date(2024, 2, 20, 12, 0, 0, 0, time.UTC)
+
+	BeforeEach(func() {
+		journal = storage.NewMemoryJournal()
+		j = storage.NewJournaledCache(storage.NewInMemoryCache(), journal)
+		var c storage.RWCache = j // force breakage if we fail to implement the interface
+
+		clock = storage.NewManualClock(start)
+		j.SetClock(clock)
+		root = []byte("{\"name\":\"root\"}")
+		Expect(c.Write("root", root)).To(Succeed())
+		clock.Advance(time.Second)
+		child1 = []byte("{\"name\":\"baby\"}")
+		Expect(c.Write("root/child1", child1)).To(Succeed())
+		child2 = []byte("{\"name\":\"kid\"}")
+		Expect(c.Write("root/child2", child2)).To(Succeed())
+	})
+
+	It("should record every mutation with its time", func() {
+		Expect(j.Delete("root/child1")).To(BeTrue())
+		Expect(journal.Entries()).To(Equal([]storage.JournalEntry{
+			{Time: start, Op: storage.JournalWrite, Location: "root", Data: root},
+			{Time: start.Add(time.Second), Op: storage.JournalWrite, Location: "root/child1", Data: child1},
+			{Time: start.Add(time.Second), Op: storage.JournalWrite, Location: "root/child2", Data: child2},
+			{Time: start.Add(time.Second), Op: storage.JournalDelete, Location: "root/child1"},
+		}))
+		Expect(j.Err()).NotTo(HaveOccurred())
+	})
+
+	It("should not record mutations that fail or change nothing", func() {
+		Expect(j.Delete("missing")).To(BeFalse())
+		Expect(j.DeleteTree("missing")).To(BeFalse())
+		err := j.WriteIf("root", child1, 0)
+		Expect(storage.IsVersionConflict(err)).To(BeTrue())
+		Expect(journal.Entries()).To(HaveLen(3))
+	})
+
+	It("should rebuild a store by replaying the journal", func() {
+		Expect(j.DeleteTree("root/")).To(BeTrue())
+		Expect(j.Write("root/child3", child2)).To(Succeed())
+
+		m := storage.NewInMemoryCache()
+		Expect(storage.Replay(journal, m)).To(Succeed())
+		Expect(m.ListTree("root/", 0)).To(Equal([]string{"root/child3"}))
+		Expect(m.Read("root")).To(Equal(root))
+		Expect(m.Read("root/child3")).To(Equal(child2))
+	})
+
+	It("should record the changes made by transactions once they are applied", func() {
+		err := j.Update(func(tx storage.RWCache) error {
+			Expect(tx.Write("root/child3", child1)).To(Succeed())
+			Expect(tx.Delete("root/child3")).To(BeTrue())
+			return tx.Write("root/child1", child2)
+		})
+		Expect(err).NotTo(HaveOccurred())
+		err = j.Update(func(tx storage.RWCache) error {
+			Expect(tx.Delete("root/child2")).To(BeTrue())
+			return storage.ErrNoSnapshot
+		})
+		Expect(err).To(MatchError(storage.ErrNoSnapshot))
+
+		entries, err := journal.Entries()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entries).To(HaveLen(4))
+		Expect(entries[3]).To(Equal(storage.JournalEntry{Time: start.Add(time.Second), Op: storage.JournalWrite, Location: "root/child1", Data: child2}))
+	})
+
+	It("should record and replay objects that expire", func() {
+		Expect(j.WriteTTL("root/child3", child1, time.Minute)).To(Succeed())
+		entries, err := journal.Entries()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entries[3]).To(HaveField("TTL", time.Minute))
+
+		m := storage.NewInMemoryCache()
+		m.SetClock(clock)
+		Expect(storage.Replay(journal, m)).To(Succeed())
+		Expect(m.Read("root/child3")).To(Equal(child1))
+		clock.Advance(time.Minute)
+		Expect(m.Exists("root/child3")).To(BeFalse())
+	})
+
+	It("should fork and watch the store without journaling", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		events := j.Watch(ctx, "root/")
+		fork, err := j.Fork()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fork.Write("root/child3", child1)).To(Succeed())
+		Expect(j.Delete("root/child1")).To(BeTrue())
+
+		Eventually(events).Should(Receive(HaveField("Location", "root/child1")))
+		Expect(j.Exists("root/child3")).To(BeFalse())
+		Expect(journal.Entries()).To(HaveLen(4))
+	})
+
+	It("should fail operations the store does not support", func() {
+		j = storage.NewJournaledCache(storage.NewFileStorage(GinkgoT().TempDir()), journal)
+		Expect(j.WriteTTL("root/child3", child1, time.Minute)).To(MatchError(storage.ErrExpiriesUnsupported))
+		Expect(j.Fork()).Error().To(MatchError(storage.ErrForksUnsupported))
+		Expect(journal.Entries()).To(HaveLen(3))
+	})
+
+	Describe("FileJournal", func() {
+		It("should persist the journal across restarts", func() {
+			name := filepath.Join(GinkgoT().TempDir(), "journal.ndjson")
+			f, err := storage.OpenFileJournal(name)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(storage.Replay(journal, storage.NewJournaledCache(storage.NewInMemoryCache(), f))).To(Succeed())
+			Expect(f.Close()).To(Succeed())
+
+			f, err = storage.OpenFileJournal(name)
+			Expect(err).NotTo(HaveOccurred())
+			defer f.Close()
+			Expect(f.Entries()).To(HaveLen(3))
+
+			m := storage.NewInMemoryCache()
+			Expect(storage.Replay(f, m)).To(Succeed())
+			Expect(m.List("root/")).To(Equal([]string{"root/child1", "root/child2"}))
+			Expect(m.Read("root/child2")).To(Equal(child2))
+
+			j = storage.NewJournaledCache(m, f)
+			Expect(j.Delete("root/child2")).To(BeTrue())
+			Expect(f.Entries()).To(HaveLen(4))
+		})
+	})
+})
@@ -2,77 +2,225 @@ package storage
 
 import (
 	"bytes"
+	"context"
 	"path"
-	"slices"
 	"strings"
+	"sync"
+	"time"
 )
 
+// InMemoryCache keeps its objects in memory, in a persistent tree ordered by location,
+// so listing a prefix only visits the objects beneath it.  Forks and snapshots share the
+// tree, since it is never modified, only replaced.
 type InMemoryCache struct {
-	cache map[string]record
+	mu          sync.RWMutex
+	objects     *tree
+	lists       map[string]collectionRecord
+	clock       Clock
+	version     uint64
+	checkpoints checkpoints
+	watchers    watchers
+	expiries    expiries
 }
 
 func NewInMemoryCache() *InMemoryCache {
 	return &InMemoryCache{
-		cache: map[string]record{},
+		lists: map[string]collectionRecord{},
+		clock: SystemClock,
 	}
 }
 
+func (m *InMemoryCache) SetClock(clock Clock) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.clock = clock
+}
+
+func (m *InMemoryCache) Watch(ctx context.Context, prefix string) <-chan Event {
+	return m.watchers.watch(ctx, prefix)
+}
+
 func (m *InMemoryCache) Clear() {
-	m.cache = map[string]record{}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.objects = nil
+	m.lists = map[string]collectionRecord{}
+	m.expiries = expiries{}
 }
 
 func (m *InMemoryCache) Reset() {
-	m.cache = map[string]record{}
+	m.Clear()
 }
 
 func (m *InMemoryCache) Read(location string) (data []byte, err error) {
 	if strings.HasSuffix(location, "/") {
-		err = newError(location, ErrLocationNotObject)
-	} else if r, ok := m.cache[location]; !ok {
+		return nil, newError(location, ErrLocationNotObject)
+	}
+
+	m.reap()
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if r, ok := m.objects.get(location); !ok {
 		err = newError(location, ErrObjectNotFound)
-	} else if r.kind() != kindObject {
-		err = newError(location, ErrKindNotObject)
 	} else {
-		data = r.(objectRecord).data
+		data = r.data
 	}
 	return
 }
 
+func (m *InMemoryCache) Stat(location string) (Metadata, error) {
+	if strings.HasSuffix(location, "/") {
+		return Metadata{}, newError(location, ErrLocationNotObject)
+	}
+
+	m.reap()
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	r, ok := m.objects.get(location)
+	if !ok {
+		return Metadata{}, newError(location, ErrObjectNotFound)
+	}
+	return r.metadata(location), nil
+}
+
 func (m *InMemoryCache) Exists(location string) bool {
-	r, ok := m.cache[location]
-	return ok && r.kind() == kindObject
+	m.reap()
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	_, ok := m.objects.get(location)
+	return ok
 }
 
-func (m *InMemoryCache) List(location string) (subkeys []string, err error) {
-	if subdir, ok := strings.CutSuffix(location, "/"); !ok {
-		err = newError(location, ErrLocationNotPrefix)
-	} else if r, ok := m.cache[location]; ok {
-		if r.kind() != kindCollection {
-			err = newError(location, ErrKindNotPrefix)
-		} else {
-			subkeys = r.(collectionRecord).subkeys
+func (m *InMemoryCache) List(location string) ([]string, error) {
+	if !strings.HasSuffix(location, "/") {
+		return nil, newError(location, ErrLocationNotPrefix)
+	}
+
+	// Return the data if it is cached
+	m.reap()
+	m.mu.RLock()
+	r, ok := m.lists[location]
+	m.mu.RUnlock()
+	if ok {
+		return r.subkeys, nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.list(location)
+}
+
+// list must be called with the write lock held, since it caches its result.
+func (m *InMemoryCache) list(location string) (subkeys []string, err error) {
+	if r, ok := m.lists[location]; ok {
+		return r.subkeys, nil
+	}
+	if subkeys, err = m.descendants(location, 1); err == nil {
+		m.lists[location] = collectionRecord{subkeys: subkeys}
+	}
+	return
+}
+
+func (m *InMemoryCache) ListTree(location string, depth int) ([]string, error) {
+	if location != "" && !strings.HasSuffix(location, "/") {
+		return nil, newError(location, ErrLocationNotPrefix)
+	} else if depth == 1 && location != "" {
+		return m.List(location)
+	}
+
+	m.reap()
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.descendants(location, depth)
+}
+
+// descendants lists the objects beneath a prefix, up to depth levels deep.  It must be
+// called with a lock held.
+func (m *InMemoryCache) descendants(location string, depth int) ([]string, error) {
+	if !m.found(location) {
+		return nil, newError(location, ErrPrefixNotFound)
+	}
+	subkeys := []string{}
+	m.walk(location, location, depth, func(key string, _ objectRecord) bool {
+		subkeys = append(subkeys, key)
+		return true
+	})
+	return subkeys, nil
+}
+
+// walk calls fn in order for each object beneath a prefix, starting at a location, up to
+// depth levels deep, skipping over any deeper subtrees, until fn returns false.  It must
+// be called with a lock held.
+func (m *InMemoryCache) walk(location, from string, depth int, fn func(key string, r objectRecord) bool) {
+	for {
+		key, r, ok := m.objects.ceiling(from)
+		if !ok || !strings.HasPrefix(key, location) {
+			return
 		}
-	} else {
-		// Workaround since in-memory caches cannot test directory presence.
-		// Test for parent key existence instead.
-		parent := path.Dir(subdir)
-		if parent != "." {
-			if _, ok := m.cache[parent]; !ok {
-				err = newError(location, ErrPrefixNotFound)
+		if i := pastDepth(location, key, depth); i < 0 {
+			if !fn(key, r) {
 				return
 			}
+			from = key + "\x00"
+		} else {
+			from = key[:i] + "0" // "0" is the next character after "/"
 		}
+	}
+}
 
-		subkeys = make([]string, 0, len(m.cache))
-		for key := range m.cache {
-			if strings.HasPrefix(key, location) {
-				subkeys = append(subkeys, key)
-			}
-		}
-		slices.Sort(subkeys)
-		m.cache[location] = collectionRecord{subkeys: subkeys}
+// found returns whether a prefix exists.  It must be called with a lock held.
+//
+// Workaround since in-memory caches cannot test directory presence.  Test for any
+// nested objects, or for parent key existence instead.
+func (m *InMemoryCache) found(location string) bool {
+	subdir, _ := strings.CutSuffix(location, "/")
+	if parent := path.Dir(subdir); parent == "." {
+		return true
+	} else if _, ok := m.objects.get(parent); ok {
+		return true
 	}
-	return
+	key, _, ok := m.objects.ceiling(location)
+	return ok && strings.HasPrefix(key, location)
+}
+
+func (m *InMemoryCache) ReadPage(location string, options PageOptions) (*Page, error) {
+	if !strings.HasSuffix(location, "/") {
+		return nil, newError(location, ErrLocationNotPrefix)
+	}
+	after, err := decodeToken(location, options.Token)
+	if err != nil {
+		return nil, err
+	}
+
+	m.reap()
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if !m.found(location) {
+		return nil, newError(location, ErrPrefixNotFound)
+	}
+
+	// Walk from just after the token, visiting only the skipped objects and the page.
+	from := location
+	if after != "" {
+		from = after + "\x00"
+	}
+	var keys []string
+	var objects [][]byte
+	var next string
+	skip := options.Offset
+	m.walk(location, from, 1, func(key string, r objectRecord) bool {
+		if skip > 0 {
+			skip--
+			return true
+		} else if options.Limit > 0 && len(keys) == options.Limit {
+			next = encodeToken(keys[len(keys)-1])
+			return false
+		}
+		keys = append(keys, key)
+		objects = append(objects, r.data)
+		return true
+	})
+	return NewPage(keys, objects, next), nil
 }
 
 func (m *InMemoryCache) ReadList(location string) ([]byte, error) {
@@ -80,20 +228,24 @@ func (m *InMemoryCache) ReadList(location string) ([]byte, error) {
 		return nil, newError(location, ErrLocationNotPrefix)
 	}
 
+	// Return the data if it is cached
+	m.reap()
+	m.mu.RLock()
+	r, ok := m.lists[location]
+	m.mu.RUnlock()
+	if ok && r.data != nil {
+		return r.data, nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	// Hydrate the file list if the data is not cached.
-	var subkeys []string
-	var err error
-	if r, ok := m.cache[location]; !ok {
-		subkeys, err = m.List(location)
-		if err != nil {
-			return nil, err
-		}
-	} else if r.kind() != kindCollection {
-		return nil, newError(location, ErrKindNotPrefix)
-	} else if r.(collectionRecord).data != nil {
-		return r.(collectionRecord).data, nil
-	} else {
-		subkeys = r.(collectionRecord).subkeys
+	subkeys, err := m.list(location)
+	if err != nil {
+		return nil, err
+	} else if r := m.lists[location]; r.data != nil {
+		return r.data, nil
 	}
 
 	// Build an object record for this collection.
@@ -103,13 +255,14 @@ func (m *InMemoryCache) ReadList(location string) ([]byte, error) {
 		if i > 0 {
 			buff.WriteString(",")
 		}
-		buff.Write(m.cache[subkey].(objectRecord).data)
+		r, _ := m.objects.get(subkey)
+		buff.Write(r.data)
 	}
 	buff.WriteString("]")
 
 	// Cache the result and return it
 	b := buff.Bytes()
-	m.cache[location] = collectionRecord{data: b, subkeys: subkeys}
+	m.lists[location] = collectionRecord{data: b, subkeys: subkeys}
 	return b, nil
 }
 
@@ -118,27 +271,235 @@ func (m *InMemoryCache) Write(location string, data []byte) error {
 		return newError(location, ErrLocationNotObject)
 	}
 
-	m.cache[location] = objectRecord{data: data}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expire()
+	m.write(location, data)
+	return nil
+}
+
+func (m *InMemoryCache) WriteIf(location string, data []byte, version uint64) error {
+	if strings.HasSuffix(location, "/") {
+		return newError(location, ErrLocationNotObject)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expire()
+	if err := checkVersion(location, m.current(location), version); err != nil {
+		return err
+	}
+	m.write(location, data)
+	return nil
+}
+
+// current returns the version of an object, or 0 if there is no such object.  It must be
+// called with a lock held.
+func (m *InMemoryCache) current(location string) uint64 {
+	r, _ := m.objects.get(location)
+	return r.version
+}
+
+// advance makes sure that every version written from now on is greater than floor.
+func (m *InMemoryCache) advance(floor uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.version < floor {
+		m.version = floor
+	}
+}
+
+// write must be called with the write lock held.
+func (m *InMemoryCache) write(location string, data []byte) {
+	// Keep the creation time of any object being replaced
+	now := m.clock.Now()
+	created := now
+	r, existed := m.objects.get(location)
+	if existed {
+		created = r.created
+	}
+	m.version++
+	m.objects = m.objects.insert(location, objectRecord{data: data, version: m.version, created: created, updated: now})
+	m.expiries.remove(location)
+	m.watchers.written(location, data, m.version, existed)
 
 	// Invalidate any cached list
 	if parent := path.Dir(location); parent != "." {
-		delete(m.cache, parent+"/")
+		delete(m.lists, parent+"/")
 	}
+}
+
+func (m *InMemoryCache) WriteTTL(location string, data []byte, ttl time.Duration) error {
+	if strings.HasSuffix(location, "/") {
+		return newError(location, ErrLocationNotObject)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expire()
+	m.write(location, data)
+	m.expiries.set(location, m.clock.Now().Add(ttl))
 	return nil
 }
 
+// reap deletes any objects that have expired, before reading.
+func (m *InMemoryCache) reap() {
+	m.mu.RLock()
+	due := m.expiries.due(m.clock.Now())
+	m.mu.RUnlock()
+	if due {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.expire()
+	}
+}
+
+// expire deletes any objects that have expired.  It must be called with the write lock held.
+func (m *InMemoryCache) expire() {
+	if now := m.clock.Now(); m.expiries.due(now) {
+		for _, location := range m.expiries.take(now) {
+			m.delete(location)
+		}
+	}
+}
+
 func (m *InMemoryCache) Delete(location string) bool {
 	if strings.HasSuffix(location, "/") {
 		return false
 	}
 
-	// Record whether it exists, then delete it
-	_, ok := m.cache[location]
-	delete(m.cache, location)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expire()
+	return m.delete(location)
+}
+
+func (m *InMemoryCache) DeleteIf(location string, version uint64) error {
+	if strings.HasSuffix(location, "/") {
+		return newError(location, ErrLocationNotObject)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expire()
+	if err := checkDelete(location, m.current(location), version); err != nil {
+		return err
+	}
+	m.delete(location)
+	return nil
+}
+
+// delete must be called with the write lock held.
+func (m *InMemoryCache) delete(location string) bool {
+	var ok bool
+	if m.objects, ok = m.objects.remove(location); ok {
+		m.watchers.deleted(location)
+	}
+	m.expiries.remove(location)
 
 	// Invalidate any cached list
 	if parent := path.Dir(location); parent != "." {
-		delete(m.cache, parent+"/")
+		delete(m.lists, parent+"/")
 	}
 	return ok
 }
+
+func (m *InMemoryCache) DeleteTree(location string) bool {
+	object, prefix := treePrefix(location)
+	if prefix == "/" {
+		return false
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expire()
+
+	var locations []string
+	if _, ok := m.objects.get(object); ok && object != "" {
+		locations = append(locations, object)
+	}
+	m.objects.ascend(prefix, func(key string, _ objectRecord) bool {
+		if !strings.HasPrefix(key, prefix) {
+			return false
+		}
+		locations = append(locations, key)
+		return true
+	})
+	for _, key := range locations {
+		m.objects, _ = m.objects.remove(key)
+		m.watchers.deleted(key)
+	}
+	m.expiries.removeTree(object, prefix)
+
+	// Invalidate every cached list, since lists may include nested objects
+	m.lists = map[string]collectionRecord{}
+	return len(locations) > 0
+}
+
+func (m *InMemoryCache) Update(fn func(tx RWCache) error) error {
+	return update(m, fn, m.commit)
+}
+
+// commit applies a transaction's changes while holding the write lock, so that readers
+// see all of them or none of them.
+func (m *InMemoryCache) commit(changes []change) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expire()
+	if err := checkChanges(changes, m.current); err != nil {
+		return err
+	}
+	for _, c := range changes {
+		if c.deleted {
+			m.delete(c.location)
+		} else {
+			m.write(c.location, c.data)
+		}
+	}
+	return nil
+}
+
+// Fork returns a new InMemoryCache sharing this cache's current contents.  It takes
+// constant time, since neither cache modifies the shared tree afterwards.
+func (m *InMemoryCache) Fork() (RWCache, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return &InMemoryCache{
+		objects:  m.objects,
+		lists:    map[string]collectionRecord{},
+		clock:    m.clock,
+		version:  m.version,
+		expiries: m.expiries.clone(),
+	}, nil
+}
+
+func (m *InMemoryCache) Snapshot() (*Snapshot, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return &Snapshot{objects: m.objects, expiries: m.expiries.clone()}, nil
+}
+
+func (m *InMemoryCache) Restore(snapshot *Snapshot) error {
+	if snapshot == nil {
+		return ErrNoSnapshot
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.objects = snapshot.objects
+	m.lists = map[string]collectionRecord{}
+	m.expiries = snapshot.expiries.clone()
+	return nil
+}
+
+func (m *InMemoryCache) PushCheckpoint() error {
+	return m.checkpoints.push(m.Snapshot())
+}
+
+func (m *InMemoryCache) RollbackCheckpoint() error {
+	return m.checkpoints.restore(m, false)
+}
+
+func (m *InMemoryCache) PopCheckpoint() error {
+	return m.checkpoints.restore(m, true)
+}
@@ -0,0 +1,53 @@
+package storage_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github/joekhoobyar/epigon/storage"
+)
+
+// seed writes n objects spread across ten collections beneath root.
+func seed(n int) *storage.InMemoryCache {
+	m := storage.NewInMemoryCache()
+	m.Write("root", []byte("{}")) // nolint
+	for i := 0; i < 10; i++ {
+		m.Write(fmt.Sprintf("root/child%d", i), []byte("{}")) // nolint
+	}
+	for i := 0; i < n; i++ {
+		m.Write(fmt.Sprintf("root/child%d/%08d", i%10, i), []byte("{}")) // nolint
+	}
+	return m
+}
+
+// BenchmarkInMemoryWriteList writes to one small collection and lists it, which
+// invalidates the cached list every time.  Its cost should not grow with the store.
+func BenchmarkInMemoryWriteList(b *testing.B) {
+	for _, n := range []int{1000, 10000, 100000} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			m := seed(n)
+			m.Write("other", []byte("{}")) // nolint
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				m.Write(fmt.Sprintf("other/%d", i%10), []byte("{}")) // nolint
+				if _, err := m.List("other/"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkInMemoryFork forks a store and writes to the fork.
+func BenchmarkInMemoryFork(b *testing.B) {
+	for _, n := range []int{1000, 10000, 100000} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			m := seed(n)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				f, _ := m.Fork()
+				f.Write("root/child0/new", []byte("{}")) // nolint
+			}
+		})
+	}
+}
@@ -1,6 +1,12 @@
 package storage_test
 
 import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 
@@ -96,6 +102,31 @@ var _ = Describe("InMemoryCache", func() {
 				Expect(m.List("root/child3/nest/")).Error().To(HaveOccurred())
 			})
 		})
+
+		Context("that are trees", func() {
+			BeforeEach(func() {
+				Expect(m.Write("root/child1/nest/arm", []byte("\"arm\""))).To(Succeed())
+				Expect(m.Write("root/child1/nest/leg", []byte("\"leg\""))).To(Succeed())
+				Expect(m.Write("root/child1/nest/leg/toe", []byte("\"toe\""))).To(Succeed())
+			})
+
+			It("should leave nested subkeys out of lists", func() {
+				Expect(m.List("root/")).To(Equal([]string{"root/child1", "root/child2"}))
+				Expect(m.ReadList("root/")).To(Equal([]byte("[" + string(child1) + "," + string(child2) + "]")))
+			})
+			It("should list nested subkeys at any depth", func() {
+				Expect(m.ListTree("root/", 0)).To(Equal([]string{"root/child1", "root/child1/nest/arm",
+					"root/child1/nest/leg", "root/child1/nest/leg/toe", "root/child2"}))
+			})
+			It("should limit the depth", func() {
+				Expect(m.ListTree("root/", 2)).To(Equal([]string{"root/child1", "root/child2"}))
+				Expect(m.ListTree("root/", 3)).To(Equal([]string{"root/child1", "root/child1/nest/arm",
+					"root/child1/nest/leg", "root/child2"}))
+			})
+			It("should find prefixes holding only nested subkeys", func() {
+				Expect(m.List("root/child1/")).To(Equal([]string{}))
+			})
+		})
 	})
 
 	Describe("Writing locations", func() {
@@ -151,4 +182,511 @@ var _ = Describe("InMemoryCache", func() {
 			})
 		})
 	})
+
+	Describe("Deleting trees", func() {
+		BeforeEach(func() {
+			Expect(m.Write("root/child1/nest/arm", []byte("\"arm\""))).To(Succeed())
+			Expect(m.Write("root/child1/nest/leg", []byte("\"leg\""))).To(Succeed())
+		})
+
+		It("should delete the object and everything beneath it", func() {
+			Expect(m.DeleteTree("root/child1")).To(BeTrue())
+			Expect(m.Exists("root/child1")).To(BeFalse())
+			Expect(m.Exists("root/child1/nest/arm")).To(BeFalse())
+			Expect(m.Exists("root/child1/nest/leg")).To(BeFalse())
+			Expect(m.List("root/")).To(Equal([]string{"root/child2"}))
+		})
+		It("should keep the object when deleting a prefix", func() {
+			Expect(m.DeleteTree("root/child1/")).To(BeTrue())
+			Expect(m.Exists("root/child1")).To(BeTrue())
+			Expect(m.Exists("root/child1/nest/arm")).To(BeFalse())
+		})
+		It("should leave the original of a fork intact", func() {
+			f, err := m.Fork()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(f.DeleteTree("root/child1")).To(BeTrue())
+			Expect(f.Exists("root/child1/nest/leg")).To(BeFalse())
+			Expect(m.Exists("root/child1/nest/leg")).To(BeTrue())
+		})
+		It("should fail for missing trees", func() {
+			Expect(m.DeleteTree("missing")).To(BeFalse())
+		})
+	})
+
+	Describe("Metadata", func() {
+		var clock *storage.ManualClock
+		start := time.Date(2024, 2, 20, 12, 0, 0, 0, time.UTC)
+
+		BeforeEach(func() {
+			clock = storage.NewManualClock(start)
+			m.SetClock(clock)
+			DeferCleanup(m.SetClock, storage.SystemClock)
+		})
+
+		It("should timestamp new objects with the clock", func() {
+			Expect(m.Write("other", child1)).To(Succeed())
+			meta, err := m.Stat("other")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(meta.Location).To(Equal("other"))
+			Expect(meta.Size).To(Equal(len(child1)))
+			Expect(meta.Created).To(Equal(start))
+			Expect(meta.Updated).To(Equal(start))
+		})
+		It("should keep the creation time and increase the version on updates", func() {
+			Expect(m.Write("other", child1)).To(Succeed())
+			before, err := m.Stat("other")
+			Expect(err).NotTo(HaveOccurred())
+
+			clock.Advance(time.Minute)
+			Expect(m.Write("other", child2)).To(Succeed())
+			after, err := m.Stat("other")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(after.Version).To(BeNumerically(">", before.Version))
+			Expect(after.Created).To(Equal(start))
+			Expect(after.Updated).To(Equal(start.Add(time.Minute)))
+		})
+		It("should keep increasing versions after restoring snapshots", func() {
+			snapshot, err := m.Snapshot()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(m.Write("root", child1)).To(Succeed())
+			written, _ := m.Stat("root")
+			Expect(m.Restore(snapshot)).To(Succeed())
+			Expect(m.Write("root", child2)).To(Succeed())
+			Expect(m.Stat("root")).To(HaveField("Version", BeNumerically(">", written.Version)))
+		})
+		It("should fail for missing objects", func() {
+			_, err = m.Stat("missing")
+			Expect(storage.IsObjectNotFound(err)).To(BeTrue())
+		})
+	})
+
+	Describe("Conditional writes", func() {
+		It("should write only if the version matches", func() {
+			meta, err := m.Stat("root/child1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(m.WriteIf("root/child1", child2, meta.Version)).To(Succeed())
+			err = m.WriteIf("root/child1", child1, meta.Version)
+			Expect(storage.IsVersionConflict(err)).To(BeTrue())
+			Expect(m.Read("root/child1")).To(Equal(child2))
+		})
+		It("should create only if there is no object", func() {
+			Expect(m.WriteIf("other", child1, 0)).To(Succeed())
+			err = m.WriteIf("other", child2, 0)
+			Expect(storage.IsVersionConflict(err)).To(BeTrue())
+			Expect(m.Read("other")).To(Equal(child1))
+		})
+		It("should delete only if the version matches", func() {
+			meta, err := m.Stat("root/child1")
+			Expect(err).NotTo(HaveOccurred())
+			err = m.DeleteIf("root/child1", meta.Version+1)
+			Expect(storage.IsVersionConflict(err)).To(BeTrue())
+			Expect(m.DeleteIf("root/child1", meta.Version)).To(Succeed())
+			err = m.DeleteIf("root/child1", meta.Version)
+			Expect(storage.IsObjectNotFound(err)).To(BeTrue())
+		})
+		It("should let only one of many concurrent writers win", func() {
+			meta, err := m.Stat("root/child1")
+			Expect(err).NotTo(HaveOccurred())
+			var wg sync.WaitGroup
+			var mu sync.Mutex
+			var wins int
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if m.WriteIf("root/child1", child2, meta.Version) == nil {
+						mu.Lock()
+						wins++
+						mu.Unlock()
+					}
+				}()
+			}
+			wg.Wait()
+			Expect(wins).To(Equal(1))
+		})
+	})
+
+	Describe("Expiring objects", func() {
+		var e storage.Expirer = m
+		var clock *storage.ManualClock
+
+		BeforeEach(func() {
+			clock = storage.NewManualClock(time.Date(2024, 2, 20, 12, 0, 0, 0, time.UTC))
+			m.SetClock(clock)
+			DeferCleanup(m.SetClock, storage.SystemClock)
+			Expect(e.WriteTTL("root/child3", root, time.Minute)).To(Succeed())
+		})
+
+		It("should keep objects until they expire", func() {
+			clock.Advance(time.Minute - time.Second)
+			Expect(m.Read("root/child3")).To(Equal(root))
+			Expect(m.List("root/")).To(ContainElement("root/child3"))
+		})
+		It("should delete objects once they expire", func() {
+			Expect(m.ReadList("root/")).To(ContainSubstring(string(root)))
+			clock.Advance(time.Minute)
+			Expect(m.Exists("root/child3")).To(BeFalse())
+			_, err = m.Read("root/child3")
+			Expect(storage.IsObjectNotFound(err)).To(BeTrue())
+			Expect(m.List("root/")).To(Equal([]string{"root/child1", "root/child2"}))
+			Expect(m.ReadList("root/")).NotTo(ContainSubstring(string(root)))
+		})
+		It("should keep objects written again without a TTL", func() {
+			Expect(m.Write("root/child3", child1)).To(Succeed())
+			clock.Advance(time.Hour)
+			Expect(m.Read("root/child3")).To(Equal(child1))
+		})
+		It("should expire objects in restored snapshots", func() {
+			snapshot, err := m.Snapshot()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(m.Write("root/child3", child1)).To(Succeed())
+			Expect(m.Restore(snapshot)).To(Succeed())
+			clock.Advance(time.Minute)
+			Expect(m.Exists("root/child3")).To(BeFalse())
+		})
+	})
+
+	Describe("Transactions", func() {
+		var t storage.Transactor = m
+
+		It("should apply every change at once", func() {
+			Expect(m.ReadList("root/")).To(HaveLen(len(child1) + len(child2) + 3))
+			err = t.Update(func(tx storage.RWCache) error {
+				Expect(tx.Write("root/child3", root)).To(Succeed())
+				Expect(tx.Delete("root/child1")).To(BeTrue())
+				Expect(tx.List("root/")).To(Equal([]string{"root/child2", "root/child3"}))
+				Expect(m.Exists("root/child3")).To(BeFalse())
+				Expect(m.Exists("root/child1")).To(BeTrue())
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(m.List("root/")).To(Equal([]string{"root/child2", "root/child3"}))
+			Expect(m.ReadList("root/")).To(Equal([]byte("[" + string(child2) + "," + string(root) + "]")))
+		})
+		It("should apply nothing if it fails", func() {
+			err = t.Update(func(tx storage.RWCache) error {
+				Expect(tx.Write("root/child3", root)).To(Succeed())
+				Expect(tx.DeleteTree("root")).To(BeTrue())
+				Expect(tx.Exists("root/child2")).To(BeFalse())
+				return fmt.Errorf("failed")
+			})
+			Expect(err).To(MatchError("failed"))
+			Expect(m.Exists("root")).To(BeTrue())
+			Expect(m.List("root/")).To(Equal([]string{"root/child1", "root/child2"}))
+		})
+		It("should apply nothing if another writer changed the same objects", func() {
+			err = t.Update(func(tx storage.RWCache) error {
+				Expect(tx.Write("root/child3", root)).To(Succeed())
+				Expect(tx.Write("root/child1", child2)).To(Succeed())
+				return m.Write("root/child1", root)
+			})
+			Expect(storage.IsVersionConflict(err)).To(BeTrue())
+			Expect(m.Read("root/child1")).To(Equal(root))
+			Expect(m.Exists("root/child3")).To(BeFalse())
+		})
+		It("should never show readers part of a transaction", func() {
+			Expect(m.Delete("root/child2")).To(BeTrue())
+			var wg sync.WaitGroup
+			done := make(chan struct{})
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 100; i++ {
+					t.Update(func(tx storage.RWCache) error { // nolint
+						tx.Delete("root/child1")
+						return tx.Write("root/child2", []byte(fmt.Sprint(i)))
+					})
+					t.Update(func(tx storage.RWCache) error { // nolint
+						tx.Delete("root/child2")
+						return tx.Write("root/child1", []byte(fmt.Sprint(i)))
+					})
+				}
+				close(done)
+			}()
+			for running := true; running; {
+				select {
+				case <-done:
+					running = false
+				default:
+					Expect(m.ListTree("root/", 0)).To(HaveLen(1))
+				}
+			}
+			wg.Wait()
+		})
+	})
+
+	Describe("Watching", func() {
+		var w storage.Watcher = m
+		var ctx context.Context
+		var cancel context.CancelFunc
+		var events <-chan storage.Event
+
+		BeforeEach(func() {
+			ctx, cancel = context.WithCancel(context.Background())
+			events = w.Watch(ctx, "root/")
+		})
+		AfterEach(func() { cancel() })
+
+		It("should report changes beneath the prefix in order", func() {
+			Expect(m.Write("root/child1", child2)).To(Succeed())
+			Expect(m.Write("other", root)).To(Succeed())
+			Expect(m.Write("root/child3", root)).To(Succeed())
+			Expect(m.Delete("root/child2")).To(BeTrue())
+			updated, _ := m.Stat("root/child1")
+			created, _ := m.Stat("root/child3")
+
+			var e storage.Event
+			Eventually(events).Should(Receive(&e))
+			Expect(e).To(Equal(storage.Event{Type: storage.EventUpdated, Location: "root/child1", Data: child2, Version: updated.Version}))
+			Eventually(events).Should(Receive(&e))
+			Expect(e).To(Equal(storage.Event{Type: storage.EventCreated, Location: "root/child3", Data: root, Version: created.Version}))
+			Eventually(events).Should(Receive(&e))
+			Expect(e).To(Equal(storage.Event{Type: storage.EventDeleted, Location: "root/child2"}))
+			Consistently(events).ShouldNot(Receive())
+		})
+		It("should report every object deleted in a tree", func() {
+			Expect(m.DeleteTree("root")).To(BeTrue())
+			var e storage.Event
+			Eventually(events).Should(Receive(&e))
+			Expect(e.Location).To(Equal("root/child1"))
+			Eventually(events).Should(Receive(&e))
+			Expect(e.Location).To(Equal("root/child2"))
+			Expect(e.Type).To(Equal(storage.EventDeleted))
+		})
+		It("should report changes made by transactions", func() {
+			err = m.Update(func(tx storage.RWCache) error {
+				tx.Delete("root/child1")
+				return tx.Write("root/child3", root)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			var e storage.Event
+			Eventually(events).Should(Receive(&e))
+			Expect(e.Type).To(Equal(storage.EventDeleted))
+			Eventually(events).Should(Receive(&e))
+			Expect(e.Type).To(Equal(storage.EventCreated))
+		})
+		It("should stop once cancelled", func() {
+			cancel()
+			Eventually(events).Should(BeClosed())
+			Expect(m.Write("root/child1", child2)).To(Succeed())
+		})
+	})
+
+	Describe("Paging lists", func() {
+		BeforeEach(func() {
+			for i := 0; i < 5; i++ {
+				Expect(m.Write(fmt.Sprintf("root/child2/%d", i), []byte(fmt.Sprint(i)))).To(Succeed())
+			}
+		})
+
+		It("should read pages by offset and limit", func() {
+			page, err := m.ReadPage("root/child2/", storage.PageOptions{Offset: 1, Limit: 2})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(page.Keys).To(Equal([]string{"root/child2/1", "root/child2/2"}))
+			Expect(page.Data).To(Equal([]byte("[1,2]")))
+			Expect(page.Next).NotTo(BeEmpty())
+		})
+		It("should continue from tokens while objects are written and deleted", func() {
+			page, err := m.ReadPage("root/child2/", storage.PageOptions{Limit: 2})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(page.Data).To(Equal([]byte("[0,1]")))
+
+			Expect(m.Delete("root/child2/1")).To(BeTrue())
+			Expect(m.Write("root/child2/0a", []byte("0"))).To(Succeed())
+			Expect(m.Write("root/child2/9", []byte("9"))).To(Succeed())
+			page, err = m.ReadPage("root/child2/", storage.PageOptions{Token: page.Next, Limit: 2})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(page.Data).To(Equal([]byte("[2,3]")))
+			page, err = m.ReadPage("root/child2/", storage.PageOptions{Token: page.Next, Limit: 2})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(page.Data).To(Equal([]byte("[4,9]")))
+			Expect(page.Next).To(BeEmpty())
+		})
+		It("should read every object without a limit", func() {
+			Expect(m.ReadPage("root/", storage.PageOptions{})).To(HaveField("Keys", []string{"root/child1", "root/child2"}))
+		})
+		It("should fail on invalid tokens", func() {
+			_, err = m.ReadPage("root/child2/", storage.PageOptions{Token: "!"})
+			Expect(storage.IsInvalidToken(err)).To(BeTrue())
+			_, err = m.ReadPage("root/child2/", storage.PageOptions{Token: "cm9vdC9vdGhlcg"})
+			Expect(storage.IsInvalidToken(err)).To(BeTrue())
+		})
+	})
+
+	Describe("Many objects", func() {
+		It("should list them in order after writes and deletes in any order", func() {
+			var expected []string
+			for _, i := range rand.Perm(1000) {
+				Expect(m.Write(fmt.Sprintf("root/child2/%04d", i), child2)).To(Succeed())
+			}
+			for i := 0; i < 1000; i++ {
+				if key := fmt.Sprintf("root/child2/%04d", i); i%3 == 0 {
+					Expect(m.Delete(key)).To(BeTrue())
+				} else {
+					expected = append(expected, key)
+				}
+			}
+			Expect(m.List("root/child2/")).To(Equal(expected))
+			Expect(m.List("root/")).To(Equal([]string{"root/child1", "root/child2"}))
+			Expect(m.ListTree("root/", 0)).To(HaveLen(len(expected) + 2))
+		})
+	})
+
+	Describe("Concurrent access", func() {
+		It("should be safe for parallel readers and writers", func() {
+			var wg sync.WaitGroup
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func(key string) {
+					defer wg.Done()
+					defer GinkgoRecover()
+					for j := 0; j < 100; j++ {
+						Expect(m.Write(key, child1)).To(Succeed())
+						Expect(m.Read("root/child2")).To(Equal(child2))
+						Expect(m.Exists(key)).To(BeTrue())
+						Expect(m.List("root/")).To(ContainElement("root/child2"))
+						Expect(m.ReadList("root/")).To(ContainSubstring("\"kid\""))
+						Expect(m.Delete(key)).To(BeTrue())
+					}
+				}(fmt.Sprintf("root/worker%d", i))
+			}
+			wg.Wait()
+			Expect(m.List("root/")).To(Equal([]string{"root/child1", "root/child2"}))
+		})
+	})
+
+	Describe("Snapshots", func() {
+		var sm *storage.InMemoryCache
+		var s storage.Snapshotter
+
+		BeforeEach(func() {
+			sm = storage.NewInMemoryCache()
+			s = sm // force breakage if we fail to implement the interface
+			Expect(sm.Write("root", root)).To(Succeed())
+			Expect(sm.Write("root/child1", child1)).To(Succeed())
+		})
+
+		It("should restore a snapshot", func() {
+			snapshot, err := s.Snapshot()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(sm.List("root/")).To(Equal([]string{"root/child1"}))
+
+			Expect(sm.Write("root/child2", child2)).To(Succeed())
+			Expect(sm.Delete("root/child1")).To(BeTrue())
+			Expect(s.Restore(snapshot)).To(Succeed())
+
+			Expect(sm.Read("root/child1")).To(Equal(child1))
+			Expect(sm.Exists("root/child2")).To(BeFalse())
+			Expect(sm.List("root/")).To(Equal([]string{"root/child1"}))
+		})
+		It("should restore a snapshot more than once", func() {
+			snapshot, err := s.Snapshot()
+			Expect(err).NotTo(HaveOccurred())
+			for i := 0; i < 2; i++ {
+				Expect(sm.Write("root/child2", child2)).To(Succeed())
+				Expect(s.Restore(snapshot)).To(Succeed())
+				Expect(sm.Exists("root/child2")).To(BeFalse())
+			}
+		})
+		It("should fail to restore a missing snapshot", func() {
+			Expect(s.Restore(nil)).To(MatchError(storage.ErrNoSnapshot))
+		})
+		It("should roll back to the same checkpoint repeatedly", func() {
+			Expect(s.PushCheckpoint()).To(Succeed())
+			for i := 0; i < 2; i++ {
+				Expect(sm.Write("root/child2", child2)).To(Succeed())
+				Expect(s.RollbackCheckpoint()).To(Succeed())
+				Expect(sm.Exists("root/child2")).To(BeFalse())
+				Expect(sm.Read("root/child1")).To(Equal(child1))
+			}
+		})
+		It("should pop nested checkpoints", func() {
+			Expect(s.PushCheckpoint()).To(Succeed())
+			Expect(sm.Write("root/child2", child2)).To(Succeed())
+			Expect(s.PushCheckpoint()).To(Succeed())
+			Expect(sm.Delete("root/child1")).To(BeTrue())
+
+			Expect(s.PopCheckpoint()).To(Succeed())
+			Expect(sm.List("root/")).To(Equal([]string{"root/child1", "root/child2"}))
+			Expect(s.PopCheckpoint()).To(Succeed())
+			Expect(sm.List("root/")).To(Equal([]string{"root/child1"}))
+			Expect(s.PopCheckpoint()).To(MatchError(storage.ErrNoCheckpoint))
+		})
+	})
+
+	Describe("Forks", func() {
+		var parent *storage.InMemoryCache
+		var f storage.Forker
+		guy := []byte("\"guy\"")
+
+		BeforeEach(func() {
+			parent = storage.NewInMemoryCache()
+			f = parent // force breakage if we fail to implement the interface
+			Expect(parent.Write("root", root)).To(Succeed())
+			Expect(parent.Write("root/child1", child1)).To(Succeed())
+			Expect(parent.Write("root/child2", child2)).To(Succeed())
+		})
+
+		It("should share the parent's contents", func() {
+			fork, err := f.Fork()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fork.Read("root/child1")).To(Equal(child1))
+			Expect(fork.List("root/")).To(Equal([]string{"root/child1", "root/child2"}))
+			Expect(fork.ReadList("root/")).To(Equal([]byte("[{\"name\":\"baby\"},{\"name\":\"kid\"}]")))
+		})
+		It("should isolate writes and deletes in either cache", func() {
+			fork, err := f.Fork()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fork.Write("root/other", guy)).To(Succeed())
+			Expect(fork.Delete("root/child1")).To(BeTrue())
+			Expect(parent.Write("root/child2", guy)).To(Succeed())
+
+			Expect(fork.List("root/")).To(Equal([]string{"root/child2", "root/other"}))
+			Expect(fork.Read("root/child2")).To(Equal(child2))
+			Expect(fork.Exists("root/child1")).To(BeFalse())
+			Expect(fork.Delete("root/child1")).To(BeFalse())
+
+			Expect(parent.List("root/")).To(Equal([]string{"root/child1", "root/child2"}))
+			Expect(parent.Read("root/child2")).To(Equal(guy))
+			Expect(parent.Exists("root/other")).To(BeFalse())
+		})
+		It("should fork forks", func() {
+			fork, err := f.Fork()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fork.Delete("root/child1")).To(BeTrue())
+			grandchild, err := fork.(storage.Forker).Fork()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(grandchild.Write("root/child1", guy)).To(Succeed())
+
+			Expect(grandchild.List("root/")).To(Equal([]string{"root/child1", "root/child2"}))
+			Expect(fork.List("root/")).To(Equal([]string{"root/child2"}))
+			Expect(parent.Read("root/child1")).To(Equal(child1))
+		})
+		It("should be discarded independently", func() {
+			fork, err := f.Fork()
+			Expect(err).NotTo(HaveOccurred())
+			fork.Reset()
+			Expect(fork.Exists("root")).To(BeFalse())
+			Expect(parent.Read("root")).To(Equal(root))
+		})
+		It("should isolate parallel forks", func() {
+			var wg sync.WaitGroup
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func(name []byte) {
+					defer wg.Done()
+					defer GinkgoRecover()
+					fork, err := f.Fork()
+					Expect(err).NotTo(HaveOccurred())
+					for j := 0; j < 100; j++ {
+						Expect(fork.Write("root/child1", name)).To(Succeed())
+						Expect(fork.Read("root/child1")).To(Equal(name))
+						Expect(fork.Delete("root/child2")).To(Equal(j == 0))
+					}
+				}([]byte(fmt.Sprintf("\"worker%d\"", i)))
+			}
+			wg.Wait()
+			Expect(parent.ReadList("root/")).To(Equal([]byte("[{\"name\":\"baby\"},{\"name\":\"kid\"}]")))
+		})
+	})
 })
@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/base64"
+	"slices"
+	"strings"
+)
+
+// PageOptions selects a page of a list.  A page starts after the location identified by
+// Token, if any, then skips Offset objects, and holds at most Limit objects, or every
+// remaining object if Limit is less than 1.
+type PageOptions struct {
+	Token  string
+	Offset int
+	Limit  int
+}
+
+// Page is a page of a list, with its objects in a JSON array.  Objects holds the same
+// objects one at a time, in the same order as Keys.  Next is an opaque token for the
+// following page, or "" if this is the last page.  Tokens identify the last location on
+// a page rather than its position, so they stay valid while objects are written or deleted.
+type Page struct {
+	Keys    []string
+	Data    []byte
+	Next    string
+	Objects [][]byte
+}
+
+// NewPage builds a page from its keys and their objects, joining the objects into Data.
+func NewPage(keys []string, objects [][]byte, next string) *Page {
+	buff := bytes.Buffer{}
+	buff.WriteString("[")
+	buff.Write(bytes.Join(objects, []byte(",")))
+	buff.WriteString("]")
+	return &Page{Keys: keys, Data: buff.Bytes(), Next: next, Objects: objects}
+}
+
+func encodeToken(location string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(location))
+}
+
+// decodeToken returns the location a page token identifies, which must be beneath a prefix.
+func decodeToken(prefix, token string) (string, error) {
+	if token == "" {
+		return "", nil
+	}
+	after, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return "", wrapError(err, prefix, ErrInvalidToken)
+	} else if !strings.HasPrefix(string(after), prefix) {
+		return "", newError(prefix, ErrInvalidToken)
+	}
+	return string(after), nil
+}
+
+// readPage reads a page from a sorted list of subkeys, reading only the objects on the
+// page.  Objects that have been deleted since the subkeys were listed are left out.
+func readPage(location string, subkeys []string, options PageOptions, read func(location string) ([]byte, error)) (*Page, error) {
+	after, err := decodeToken(location, options.Token)
+	if err != nil {
+		return nil, err
+	}
+
+	start := 0
+	if after != "" {
+		var found bool
+		if start, found = slices.BinarySearch(subkeys, after); found {
+			start++
+		}
+	}
+	if options.Offset > 0 {
+		start += options.Offset
+	}
+	end := len(subkeys)
+	if start > end {
+		start = end
+	} else if options.Limit > 0 && start+options.Limit < end {
+		end = start + options.Limit
+	}
+
+	keys := make([]string, 0, end-start)
+	objects := make([][]byte, 0, end-start)
+	for _, subkey := range subkeys[start:end] {
+		data, err := read(subkey)
+		if IsObjectNotFound(err) {
+			continue // deleted by a concurrent writer since it was listed
+		} else if err != nil {
+			return nil, err
+		}
+		keys = append(keys, subkey)
+		objects = append(objects, data)
+	}
+
+	var next string
+	if end < len(subkeys) {
+		next = encodeToken(subkeys[end-1])
+	}
+	return NewPage(keys, objects, next), nil
+}
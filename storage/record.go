@@ -1,5 +1,7 @@
 package storage
 
+import "time"
+
 type recordKind uint8
 
 const (
@@ -11,7 +13,10 @@ const (
 )
 
 type objectRecord struct {
-	data []byte
+	data    []byte
+	version uint64
+	created time.Time
+	updated time.Time
 }
 
 type collectionRecord struct {
@@ -30,6 +35,16 @@ type record interface {
 	kind() recordKind
 }
 
+func (r objectRecord) metadata(location string) Metadata {
+	return Metadata{
+		Location: location,
+		Version:  r.version,
+		Size:     len(r.data),
+		Created:  r.created,
+		Updated:  r.updated,
+	}
+}
+
 func (objectRecord) kind() recordKind {
 	return kindObject
 }
@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"errors"
+	"sync"
+)
+
+var (
+	ErrNoCheckpoint         = errors.New("storage: no checkpoint to restore")
+	ErrNoSnapshot           = errors.New("storage: no snapshot to restore")
+	ErrSnapshotsUnsupported = errors.New("storage: snapshots are not supported")
+)
+
+// Snapshot is a point-in-time copy of a store's contents, which can later be restored
+// into the same store any number of times.
+type Snapshot struct {
+	holes     *tree
+	whiteouts *tree
+	objects   *tree
+	expiries  expiries
+	layer     *Snapshot
+}
+
+// Snapshotter is implemented by stores that can save and restore their contents.
+type Snapshotter interface {
+	Snapshot() (*Snapshot, error)
+	Restore(snapshot *Snapshot) error
+
+	// PushCheckpoint saves a snapshot on top of a stack of checkpoints.
+	PushCheckpoint() error
+	// RollbackCheckpoint restores the topmost checkpoint, leaving it on the stack.
+	RollbackCheckpoint() error
+	// PopCheckpoint restores the topmost checkpoint, and removes it from the stack.
+	PopCheckpoint() error
+}
+
+// checkpoints is a stack of snapshots, shared by each Snapshotter implementation.
+type checkpoints struct {
+	mu    sync.Mutex
+	stack []*Snapshot
+}
+
+func (c *checkpoints) push(snapshot *Snapshot, err error) error {
+	if err == nil {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.stack = append(c.stack, snapshot)
+	}
+	return err
+}
+
+func (c *checkpoints) restore(s Snapshotter, pop bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.stack) == 0 {
+		return ErrNoCheckpoint
+	}
+	top := len(c.stack) - 1
+	if err := s.Restore(c.stack[top]); err != nil {
+		return err
+	}
+	if pop {
+		c.stack = c.stack[:top]
+	}
+	return nil
+}
@@ -0,0 +1,344 @@
+// Package storagetest checks that implementations of storage.RWCache behave like the
+// built-in ones.
+package storagetest
+
+import (
+	"slices"
+	"testing"
+
+	. "github.com/onsi/gomega"
+
+	"github/joekhoobyar/epigon/storage"
+)
+
+var (
+	root   = []byte("{\"name\":\"root\"}")
+	child1 = []byte("{\"name\":\"baby\"}")
+	child2 = []byte("{\"name\":\"kid\"}")
+	child3 = []byte("{\"name\":\"teen\"}")
+	arm    = []byte("{\"name\":\"arm\"}")
+)
+
+// TestRWCache runs the behavioral contract of storage.RWCache as subtests of t, against
+// stores created by newCache, which must return a new store each time it is called, with
+// nothing stored at or beneath "root".  Any other objects it starts with, such as read-only
+// fixtures, must be left alone, and must still be there after a Reset.  Stores that are
+// also Snapshotters, Forkers or Transactors are held to those contracts too.
+func TestRWCache(t *testing.T, newCache func(t *testing.T) storage.RWCache) {
+	run := func(name string, test func(g *WithT, c storage.RWCache)) {
+		t.Run(name, func(t *testing.T) {
+			test(NewWithT(t), newCache(t))
+		})
+	}
+
+	run("LocationValidation", testLocationValidation)
+	run("ReadWrite", testReadWrite)
+	run("List", testList)
+	run("ListInvalidation", testListInvalidation)
+	run("ReadList", testReadList)
+	run("ReadPage", testReadPage)
+	run("Delete", testDelete)
+	run("DeleteTree", testDeleteTree)
+	run("ConditionalWrites", testConditionalWrites)
+	run("Reset", testReset)
+
+	run("Snapshots", func(g *WithT, c storage.RWCache) {
+		if s, ok := c.(storage.Snapshotter); ok {
+			testSnapshots(g, c, s)
+		}
+	})
+	run("Forks", func(g *WithT, c storage.RWCache) {
+		if f, ok := c.(storage.Forker); ok {
+			testForks(g, c, f)
+		}
+	})
+	run("Transactions", func(g *WithT, c storage.RWCache) {
+		if tx, ok := c.(storage.Transactor); ok {
+			testTransactions(g, c, tx)
+		}
+	})
+}
+
+// seed writes an object, two children beneath it, and an object nested beneath a child.
+func seed(g *WithT, c storage.RWCache) {
+	g.Expect(c.Write("root", root)).To(Succeed())
+	g.Expect(c.Write("root/child1", child1)).To(Succeed())
+	g.Expect(c.Write("root/child2", child2)).To(Succeed())
+	g.Expect(c.Write("root/child1/nest/arm", arm)).To(Succeed())
+}
+
+func testLocationValidation(g *WithT, c storage.RWCache) {
+	seed(g, c)
+
+	_, err := c.Read("root/")
+	g.Expect(storage.IsLocationNotObject(err)).To(BeTrue(), "Read: %v", err)
+	_, err = c.Stat("root/")
+	g.Expect(storage.IsLocationNotObject(err)).To(BeTrue(), "Stat: %v", err)
+	err = c.Write("root/", root)
+	g.Expect(storage.IsLocationNotObject(err)).To(BeTrue(), "Write: %v", err)
+	err = c.WriteIf("root/", root, 0)
+	g.Expect(storage.IsLocationNotObject(err)).To(BeTrue(), "WriteIf: %v", err)
+	err = c.DeleteIf("root/", 1)
+	g.Expect(storage.IsLocationNotObject(err)).To(BeTrue(), "DeleteIf: %v", err)
+	g.Expect(c.Delete("root/")).To(BeFalse(), "Delete")
+
+	_, err = c.List("root")
+	g.Expect(storage.IsError(err, storage.ErrLocationNotPrefix)).To(BeTrue(), "List: %v", err)
+	_, err = c.ListTree("root", 0)
+	g.Expect(storage.IsError(err, storage.ErrLocationNotPrefix)).To(BeTrue(), "ListTree: %v", err)
+	_, err = c.ReadList("root")
+	g.Expect(storage.IsError(err, storage.ErrLocationNotPrefix)).To(BeTrue(), "ReadList: %v", err)
+	_, err = c.ReadPage("root", storage.PageOptions{})
+	g.Expect(storage.IsError(err, storage.ErrLocationNotPrefix)).To(BeTrue(), "ReadPage: %v", err)
+}
+
+func testReadWrite(g *WithT, c storage.RWCache) {
+	_, err := c.Read("root")
+	g.Expect(storage.IsObjectNotFound(err)).To(BeTrue(), "Read: %v", err)
+	_, err = c.Stat("root")
+	g.Expect(storage.IsObjectNotFound(err)).To(BeTrue(), "Stat: %v", err)
+	g.Expect(c.Exists("root")).To(BeFalse())
+
+	g.Expect(c.Write("root", root)).To(Succeed())
+	g.Expect(c.Read("root")).To(Equal(root))
+	g.Expect(c.Exists("root")).To(BeTrue())
+	g.Expect(c.Exists("root/")).To(BeFalse())
+	before, err := c.Stat("root")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(before.Location).To(Equal("root"))
+	g.Expect(before.Size).To(Equal(len(root)))
+	g.Expect(before.Version).NotTo(BeZero())
+
+	g.Expect(c.Write("root", child1)).To(Succeed())
+	g.Expect(c.Read("root")).To(Equal(child1))
+	after, err := c.Stat("root")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(after.Version).To(BeNumerically(">", before.Version))
+	g.Expect(after.Updated).NotTo(BeTemporally("<", before.Updated))
+}
+
+// preloaded lists every object a store started with.
+func preloaded(g *WithT, c storage.RWCache) []string {
+	locations, err := c.ListTree("", 0)
+	g.Expect(err).NotTo(HaveOccurred())
+	return locations
+}
+
+func testList(g *WithT, c storage.RWCache) {
+	all := append(preloaded(g, c), "root", "root/child1", "root/child1/nest/arm", "root/child2")
+	slices.Sort(all)
+	seed(g, c)
+
+	g.Expect(c.List("root/")).To(Equal([]string{"root/child1", "root/child2"}))
+	g.Expect(c.ListTree("root/", 1)).To(Equal([]string{"root/child1", "root/child2"}))
+	g.Expect(c.ListTree("root/", 3)).To(Equal([]string{"root/child1", "root/child1/nest/arm", "root/child2"}))
+	g.Expect(c.ListTree("root/", 0)).To(Equal([]string{"root/child1", "root/child1/nest/arm", "root/child2"}))
+	g.Expect(c.ListTree("root/", 2)).To(Equal([]string{"root/child1", "root/child2"}))
+	g.Expect(c.ListTree("", 0)).To(Equal(all))
+
+	// A prefix beneath an object exists, even if nothing is nested beneath it yet
+	g.Expect(c.List("root/child2/")).To(BeEmpty())
+	_, err := c.List("missing/deeper/")
+	g.Expect(storage.IsPrefixNotFound(err)).To(BeTrue(), "List: %v", err)
+}
+
+func testListInvalidation(g *WithT, c storage.RWCache) {
+	seed(g, c)
+	g.Expect(c.List("root/")).To(HaveLen(2))
+	g.Expect(c.ReadList("root/")).To(HaveLen(len(child1) + len(child2) + 3))
+
+	g.Expect(c.Write("root/child3", child3)).To(Succeed())
+	g.Expect(c.List("root/")).To(Equal([]string{"root/child1", "root/child2", "root/child3"}))
+	g.Expect(c.ReadList("root/")).To(Equal(array(child1, child2, child3)))
+
+	g.Expect(c.Write("root/child1", child3)).To(Succeed())
+	g.Expect(c.ReadList("root/")).To(Equal(array(child3, child2, child3)))
+
+	g.Expect(c.Delete("root/child2")).To(BeTrue())
+	g.Expect(c.List("root/")).To(Equal([]string{"root/child1", "root/child3"}))
+	g.Expect(c.ReadList("root/")).To(Equal(array(child3, child3)))
+
+	g.Expect(c.DeleteTree("root/")).To(BeTrue())
+	g.Expect(c.List("root/")).To(BeEmpty())
+	g.Expect(c.ReadList("root/")).To(Equal(array()))
+}
+
+func testReadList(g *WithT, c storage.RWCache) {
+	seed(g, c)
+	g.Expect(c.ReadList("root/")).To(Equal(array(child1, child2)))
+	g.Expect(c.ReadList("root/child1/nest/")).To(Equal(array(arm)))
+	g.Expect(c.ReadList("root/child2/")).To(Equal(array()))
+	_, err := c.ReadList("missing/deeper/")
+	g.Expect(storage.IsPrefixNotFound(err)).To(BeTrue(), "ReadList: %v", err)
+}
+
+func testReadPage(g *WithT, c storage.RWCache) {
+	seed(g, c)
+	g.Expect(c.Write("root/child3", child3)).To(Succeed())
+
+	page, err := c.ReadPage("root/", storage.PageOptions{Limit: 2})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(page.Keys).To(Equal([]string{"root/child1", "root/child2"}))
+	g.Expect(page.Data).To(Equal(array(child1, child2)))
+	g.Expect(page.Next).NotTo(BeEmpty())
+
+	// Tokens stay valid while objects are written or deleted
+	g.Expect(c.Delete("root/child2")).To(BeTrue())
+	page, err = c.ReadPage("root/", storage.PageOptions{Token: page.Next, Limit: 2})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(page.Keys).To(Equal([]string{"root/child3"}))
+	g.Expect(page.Next).To(BeEmpty())
+
+	page, err = c.ReadPage("root/", storage.PageOptions{Offset: 1})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(page.Keys).To(Equal([]string{"root/child3"}))
+
+	_, err = c.ReadPage("root/", storage.PageOptions{Token: "!"})
+	g.Expect(storage.IsInvalidToken(err)).To(BeTrue(), "ReadPage: %v", err)
+}
+
+func testDelete(g *WithT, c storage.RWCache) {
+	seed(g, c)
+
+	g.Expect(c.Delete("root/child1")).To(BeTrue())
+	g.Expect(c.Delete("root/child1")).To(BeFalse())
+	g.Expect(c.Exists("root/child1")).To(BeFalse())
+	_, err := c.Read("root/child1")
+	g.Expect(storage.IsObjectNotFound(err)).To(BeTrue(), "Read: %v", err)
+
+	// Objects nested beneath a deleted object are kept
+	g.Expect(c.Read("root/child1/nest/arm")).To(Equal(arm))
+	g.Expect(c.Delete("missing")).To(BeFalse())
+}
+
+func testDeleteTree(g *WithT, c storage.RWCache) {
+	seed(g, c)
+
+	g.Expect(c.DeleteTree("root/child1")).To(BeTrue())
+	g.Expect(c.Exists("root/child1")).To(BeFalse())
+	g.Expect(c.Exists("root/child1/nest/arm")).To(BeFalse())
+	g.Expect(c.Exists("root/child2")).To(BeTrue())
+
+	g.Expect(c.DeleteTree("root/")).To(BeTrue())
+	g.Expect(c.Exists("root/child2")).To(BeFalse())
+	g.Expect(c.Exists("root")).To(BeTrue())
+
+	g.Expect(c.DeleteTree("missing")).To(BeFalse())
+	g.Expect(c.DeleteTree("/")).To(BeFalse())
+}
+
+func testConditionalWrites(g *WithT, c storage.RWCache) {
+	seed(g, c)
+	meta, err := c.Stat("root/child1")
+	g.Expect(err).NotTo(HaveOccurred())
+
+	err = c.WriteIf("root/child1", child3, 0)
+	g.Expect(storage.IsVersionConflict(err)).To(BeTrue(), "WriteIf: %v", err)
+	g.Expect(c.WriteIf("root/child1", child3, meta.Version)).To(Succeed())
+	err = c.WriteIf("root/child1", child1, meta.Version)
+	g.Expect(storage.IsVersionConflict(err)).To(BeTrue(), "WriteIf: %v", err)
+	g.Expect(c.Read("root/child1")).To(Equal(child3))
+
+	g.Expect(c.WriteIf("root/child3", child3, 0)).To(Succeed())
+	g.Expect(c.Read("root/child3")).To(Equal(child3))
+
+	meta, err = c.Stat("root/child3")
+	g.Expect(err).NotTo(HaveOccurred())
+	err = c.DeleteIf("root/child3", meta.Version+1)
+	g.Expect(storage.IsVersionConflict(err)).To(BeTrue(), "DeleteIf: %v", err)
+	g.Expect(c.DeleteIf("root/child3", meta.Version)).To(Succeed())
+	err = c.DeleteIf("root/child3", meta.Version)
+	g.Expect(storage.IsObjectNotFound(err)).To(BeTrue(), "DeleteIf: %v", err)
+}
+
+func testReset(g *WithT, c storage.RWCache) {
+	initial := preloaded(g, c)
+	seed(g, c)
+	g.Expect(c.List("root/")).To(HaveLen(2))
+	c.Reset()
+	g.Expect(c.Exists("root")).To(BeFalse())
+	g.Expect(c.Exists("root/child1")).To(BeFalse())
+	g.Expect(c.ListTree("", 0)).To(Equal(initial))
+}
+
+func testSnapshots(g *WithT, c storage.RWCache, s storage.Snapshotter) {
+	seed(g, c)
+	snapshot, err := s.Snapshot()
+	g.Expect(err).NotTo(HaveOccurred())
+
+	g.Expect(c.Write("root/child3", child3)).To(Succeed())
+	g.Expect(c.Delete("root/child1")).To(BeTrue())
+	g.Expect(c.List("root/")).To(Equal([]string{"root/child2", "root/child3"}))
+
+	g.Expect(s.Restore(snapshot)).To(Succeed())
+	g.Expect(c.List("root/")).To(Equal([]string{"root/child1", "root/child2"}))
+	g.Expect(c.Read("root/child1")).To(Equal(child1))
+	g.Expect(s.Restore(nil)).To(MatchError(storage.ErrNoSnapshot))
+}
+
+func testForks(g *WithT, c storage.RWCache, f storage.Forker) {
+	seed(g, c)
+	fork, err := f.Fork()
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(fork.List("root/")).To(Equal([]string{"root/child1", "root/child2"}))
+
+	g.Expect(fork.Write("root/child3", child3)).To(Succeed())
+	g.Expect(fork.Delete("root/child1")).To(BeTrue())
+	g.Expect(c.Write("root/child2", child3)).To(Succeed())
+
+	g.Expect(c.List("root/")).To(Equal([]string{"root/child1", "root/child2"}))
+	g.Expect(fork.List("root/")).To(Equal([]string{"root/child2", "root/child3"}))
+	g.Expect(fork.Read("root/child2")).To(Equal(child2))
+}
+
+func testTransactions(g *WithT, c storage.RWCache, t storage.Transactor) {
+	seed(g, c)
+	g.Expect(c.ReadList("root/")).To(Equal(array(child1, child2)))
+
+	err := t.Update(func(tx storage.RWCache) error {
+		g.Expect(tx.Write("root/child3", child3)).To(Succeed())
+		g.Expect(tx.Delete("root/child1")).To(BeTrue())
+		return storage.ErrNoSnapshot
+	})
+	g.Expect(err).To(MatchError(storage.ErrNoSnapshot))
+	g.Expect(c.List("root/")).To(Equal([]string{"root/child1", "root/child2"}))
+
+	err = t.Update(func(tx storage.RWCache) error {
+		g.Expect(tx.Write("root/child3", child3)).To(Succeed())
+		g.Expect(tx.Delete("root/child1")).To(BeTrue())
+		return nil
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(c.ReadList("root/")).To(Equal(array(child2, child3)))
+
+	err = t.Update(func(tx storage.RWCache) error {
+		g.Expect(tx.Write("root/child2", child1)).To(Succeed())
+		return c.Write("root/child2", child3)
+	})
+	g.Expect(storage.IsVersionConflict(err)).To(BeTrue(), "Update: %v", err)
+	g.Expect(c.Read("root/child2")).To(Equal(child3))
+
+	// Clearing or resetting a transaction fails it, rather than being dropped
+	for _, clear := range []func(tx storage.RWCache){storage.RWCache.Clear, storage.RWCache.Reset} {
+		err = t.Update(func(tx storage.RWCache) error {
+			g.Expect(tx.Write("root/child4", child3)).To(Succeed())
+			clear(tx)
+			return nil
+		})
+		g.Expect(err).To(MatchError(storage.ErrClearedInTransaction))
+		g.Expect(c.Exists("root/child4")).To(BeFalse())
+		g.Expect(c.Read("root/child2")).To(Equal(child3))
+	}
+}
+
+// array returns the JSON array that ReadList returns for a list of objects.
+func array(objects ...[]byte) []byte {
+	data := []byte("[")
+	for i, object := range objects {
+		if i > 0 {
+			data = append(data, ',')
+		}
+		data = append(data, object...)
+	}
+	return append(data, ']')
+}
@@ -0,0 +1,44 @@
+package storagetest_test
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github/joekhoobyar/epigon/storage"
+	"github/joekhoobyar/epigon/storage/storagetest"
+)
+
+func TestInMemoryCache(t *testing.T) {
+	storagetest.TestRWCache(t, func(t *testing.T) storage.RWCache {
+		return storage.NewInMemoryCache()
+	})
+}
+
+func TestUnionedCache(t *testing.T) {
+	storagetest.TestRWCache(t, func(t *testing.T) storage.RWCache {
+		fixtures := storage.NewFixtureFS(fstest.MapFS{
+			"fixtures/one.json":        {Data: []byte("{\"name\":\"one\"}")},
+			"fixtures/nested/two.json": {Data: []byte("{\"name\":\"two\"}")},
+			"other.json":               {Data: []byte("{\"name\":\"other\"}")},
+		})
+		return storage.NewUnionedLayers(storage.NewInMemoryCache(), fixtures)
+	})
+}
+
+func TestFileStorage(t *testing.T) {
+	storagetest.TestRWCache(t, func(t *testing.T) storage.RWCache {
+		return storage.NewFileStorage(t.TempDir())
+	})
+}
+
+func TestJournaledCache(t *testing.T) {
+	storagetest.TestRWCache(t, func(t *testing.T) storage.RWCache {
+		return storage.NewJournaledCache(storage.NewInMemoryCache(), storage.NewMemoryJournal())
+	})
+}
+
+func TestFaultyCache(t *testing.T) {
+	storagetest.TestRWCache(t, func(t *testing.T) storage.RWCache {
+		return storage.NewFaultyCache(storage.NewInMemoryCache())
+	})
+}
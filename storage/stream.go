@@ -0,0 +1,99 @@
+package storage
+
+import "io"
+
+// StreamFormat selects how StreamList writes a list.
+type StreamFormat int
+
+const (
+	// StreamJSON writes a JSON array, just like ReadList returns.
+	StreamJSON StreamFormat = iota
+	// StreamNDJSON writes one object per line.
+	StreamNDJSON
+)
+
+// streamPageSize is how many objects StreamList reads at a time.
+const streamPageSize = 256
+
+var (
+	comma   = []byte(",")
+	newline = []byte("\n")
+)
+
+// StreamList writes the objects directly beneath a prefix to w, reading one page of them
+// at a time, so the list is never held in memory all at once.  Pages are continued from
+// stable tokens, so objects written or deleted while streaming may or may not be seen.
+// If w has a Flush method, it is called after each page.  Nothing is written unless the
+// first page can be read.
+func StreamList(w io.Writer, c RCache, location string, format StreamFormat) error {
+	page, err := c.ReadPage(location, PageOptions{Limit: streamPageSize})
+	if err != nil {
+		return err
+	}
+
+	if format == StreamJSON {
+		if err = writeAll(w, []byte("[")); err != nil {
+			return err
+		}
+	}
+	var objects [][]byte
+	for n := 0; ; {
+		if objects, err = pageObjects(c, page); err != nil {
+			return err
+		}
+		for _, object := range objects {
+			if format == StreamNDJSON {
+				err = writeAll(w, object, newline)
+			} else if n > 0 {
+				err = writeAll(w, comma, object)
+			} else {
+				err = writeAll(w, object)
+			}
+			if err != nil {
+				return err
+			}
+			n++
+		}
+		if f, ok := w.(interface{ Flush() }); ok {
+			f.Flush()
+		}
+
+		if page.Next == "" {
+			break
+		} else if page, err = c.ReadPage(location, PageOptions{Token: page.Next, Limit: streamPageSize}); err != nil {
+			return err
+		}
+	}
+	if format == StreamJSON {
+		err = writeAll(w, []byte("]"))
+	}
+	return err
+}
+
+// pageObjects returns the objects on a page, reading them by key if the page was built
+// without them.
+func pageObjects(c RCache, page *Page) ([][]byte, error) {
+	if page.Objects != nil || len(page.Keys) == 0 {
+		return page.Objects, nil
+	}
+	objects := make([][]byte, 0, len(page.Keys))
+	for _, key := range page.Keys {
+		data, err := c.Read(key)
+		if IsObjectNotFound(err) {
+			continue // deleted by a concurrent writer since the page was read
+		} else if err != nil {
+			return nil, err
+		}
+		objects = append(objects, data)
+	}
+	return objects, nil
+}
+
+func writeAll(w io.Writer, chunks ...[]byte) error {
+	for _, chunk := range chunks {
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
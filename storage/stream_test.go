@@ -0,0 +1,103 @@
+package storage_test
+
+import (
+	"bytes"
+	"fmt"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github/joekhoobyar/epigon/storage"
+	"github/joekhoobyar/epigon/test"
+)
+
+// flushCounter counts how many times it is flushed.
+type flushCounter struct {
+	bytes.Buffer
+	flushes int
+}
+
+func (f *flushCounter) Flush() { f.flushes++ }
+
+// pagedCache builds its own pages from the keys of another store's pages, leaving out
+// the objects unless asked to include them.
+type pagedCache struct {
+	storage.RWCache
+	objects bool
+}
+
+func (p *pagedCache) ReadPage(location string, options storage.PageOptions) (*storage.Page, error) {
+	page, err := p.RWCache.ReadPage(location, options)
+	if err != nil {
+		return nil, err
+	} else if !p.objects {
+		return &storage.Page{Keys: page.Keys, Data: page.Data, Next: page.Next}, nil
+	}
+	objects := make([][]byte, len(page.Keys))
+	for i, key := range page.Keys {
+		objects[i], _ = p.Read(key)
+	}
+	return storage.NewPage(page.Keys, objects, page.Next), nil
+}
+
+var _ = Describe("StreamList", func() {
+	var out *flushCounter
+
+	BeforeEach(func() {
+		out = &flushCounter{}
+	})
+
+	It("should stream the same JSON array as ReadList", func() {
+		u := storage.NewUnionedCache(test.FixtureDir())
+		expected, err := u.ReadList("root/")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(storage.StreamList(out, u, "root/", storage.StreamJSON)).To(Succeed())
+		Expect(out.Bytes()).To(Equal(expected))
+	})
+
+	It("should stream empty lists", func() {
+		u := storage.NewUnionedCache(test.FixtureDir())
+		Expect(storage.StreamList(out, u, "root/child2/nest/", storage.StreamJSON)).To(Succeed())
+		Expect(out.String()).To(Equal("[]"))
+	})
+
+	It("should stream one object per line", func() {
+		u := storage.NewUnionedCache(test.FixtureDir())
+		Expect(storage.StreamList(out, u, "root/child1/nest/", storage.StreamNDJSON)).To(Succeed())
+		arm, _ := u.Read("root/child1/nest/arm")
+		leg, _ := u.Read("root/child1/nest/leg")
+		Expect(out.String()).To(Equal(string(arm) + "\n" + string(leg) + "\n"))
+	})
+
+	It("should stream large lists a page at a time", func() {
+		m := storage.NewInMemoryCache()
+		Expect(m.Write("root", []byte("{}"))).To(Succeed())
+		for i := 0; i < 1000; i++ {
+			Expect(m.Write(fmt.Sprintf("root/%04d", i), []byte(fmt.Sprint(i)))).To(Succeed())
+		}
+		expected, err := m.ReadList("root/")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(storage.StreamList(out, m, "root/", storage.StreamJSON)).To(Succeed())
+		Expect(out.Bytes()).To(Equal(expected))
+		Expect(out.flushes).To(BeNumerically(">", 1))
+	})
+
+	It("should stream pages built by other stores", func() {
+		u := storage.NewUnionedCache(test.FixtureDir())
+		expected, err := u.ReadList("root/")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(storage.StreamList(out, &pagedCache{RWCache: u, objects: true}, "root/", storage.StreamJSON)).To(Succeed())
+		Expect(out.Bytes()).To(Equal(expected))
+
+		out.Reset()
+		Expect(storage.StreamList(out, &pagedCache{RWCache: u}, "root/", storage.StreamJSON)).To(Succeed())
+		Expect(out.Bytes()).To(Equal(expected))
+	})
+
+	It("should write nothing if the list is missing", func() {
+		u := storage.NewUnionedCache(test.FixtureDir())
+		err := storage.StreamList(out, u, "root/child3/nest/", storage.StreamJSON)
+		Expect(storage.IsPrefixNotFound(err)).To(BeTrue())
+		Expect(out.Len()).To(BeZero())
+	})
+})
@@ -0,0 +1,140 @@
+package storage
+
+import "hash/fnv"
+
+// tree is a persistent treap of objects, ordered by location.  A tree is never modified
+// once built:  inserting or removing an object copies the path down to it and shares the
+// rest, so any number of forks and snapshots can share a tree just by keeping its root.
+// Each node's priority is a hash of its location, so the shape of a tree only depends on
+// its contents.
+type tree struct {
+	location    string
+	priority    uint32
+	object      objectRecord
+	left, right *tree
+}
+
+func priority(location string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(location)) // nolint
+	return h.Sum32()
+}
+
+// get finds the object at a location.
+func (t *tree) get(location string) (objectRecord, bool) {
+	for t != nil {
+		switch {
+		case location < t.location:
+			t = t.left
+		case location > t.location:
+			t = t.right
+		default:
+			return t.object, true
+		}
+	}
+	return objectRecord{}, false
+}
+
+// ceiling finds the first object at or after a location.
+func (t *tree) ceiling(from string) (location string, r objectRecord, ok bool) {
+	for t != nil {
+		if t.location < from {
+			t = t.right
+		} else {
+			location, r, ok = t.location, t.object, true
+			t = t.left
+		}
+	}
+	return
+}
+
+// insert returns a tree with an object stored at a location.  Every node on the returned
+// path is new, so it is safe to rotate them.
+func (t *tree) insert(location string, r objectRecord) *tree {
+	if t == nil {
+		return &tree{location: location, priority: priority(location), object: r}
+	}
+	c := *t
+	switch {
+	case location < t.location:
+		c.left = t.left.insert(location, r)
+		if c.left.priority > c.priority {
+			return c.rotateRight()
+		}
+	case location > t.location:
+		c.right = t.right.insert(location, r)
+		if c.right.priority > c.priority {
+			return c.rotateLeft()
+		}
+	default:
+		c.object = r
+	}
+	return &c
+}
+
+func (t *tree) rotateRight() *tree {
+	l := t.left
+	t.left, l.right = l.right, t
+	return l
+}
+
+func (t *tree) rotateLeft() *tree {
+	r := t.right
+	t.right, r.left = r.left, t
+	return r
+}
+
+// remove returns a tree without the object at a location, and whether it was there.
+func (t *tree) remove(location string) (*tree, bool) {
+	if t == nil {
+		return nil, false
+	}
+	c := *t
+	var ok bool
+	switch {
+	case location < t.location:
+		if c.left, ok = t.left.remove(location); !ok {
+			return t, false
+		}
+	case location > t.location:
+		if c.right, ok = t.right.remove(location); !ok {
+			return t, false
+		}
+	default:
+		return join(t.left, t.right), true
+	}
+	return &c, true
+}
+
+// join returns a tree with the contents of two trees, where every location in l is
+// before every location in r.
+func join(l, r *tree) *tree {
+	if l == nil {
+		return r
+	} else if r == nil {
+		return l
+	} else if l.priority > r.priority {
+		c := *l
+		c.right = join(l.right, r)
+		return &c
+	}
+	c := *r
+	c.left = join(l, r.left)
+	return &c
+}
+
+// ascend calls fn for every object at or after a location in order, until fn returns false.
+// It returns false if it was stopped.
+func (t *tree) ascend(from string, fn func(location string, r objectRecord) bool) bool {
+	for t != nil {
+		if t.location < from {
+			t = t.right
+			continue
+		}
+		if !t.left.ascend(from, fn) || !fn(t.location, t.object) {
+			return false
+		}
+		t = t.right
+	}
+	return true
+}
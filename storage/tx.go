@@ -0,0 +1,169 @@
+package storage
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+)
+
+var (
+	// ErrClearedInTransaction fails a transaction that tried to clear or reset its store,
+	// which cannot be staged along with its other changes.
+	ErrClearedInTransaction    = errors.New("storage: cannot clear or reset a store in a transaction")
+	ErrTransactionsUnsupported = errors.New("storage: transactions are not supported")
+)
+
+// Transactor is implemented by stores that can apply several writes and deletes at once.
+type Transactor interface {
+	// Update calls fn with a transaction, which reads the store along with any changes
+	// made through the transaction itself.  Once fn returns nil, every change is applied
+	// at once, so that readers see all of them or none of them.  If fn returns an error,
+	// or another writer has changed any object that the transaction changed, nothing is
+	// applied.  The latter fails with ErrVersionConflict.  Transactions cannot be cleared
+	// or reset, so doing so applies nothing, and fails with ErrClearedInTransaction.
+	Update(fn func(tx RWCache) error) error
+}
+
+// change is a write or delete staged by a transaction, along with the version the object
+// had before the transaction first changed it, where version 0 means there was none.
+type change struct {
+	location string
+	version  uint64
+	data     []byte
+	deleted  bool
+}
+
+// txn stages changes in a view of a store, which is a fork of it if the store is a Forker,
+// or else an in-memory layer on top of it.  A fork isolates the transaction from any
+// writes made after it began.
+type txn struct {
+	RWCache
+	mu      sync.Mutex
+	changes map[string]*change
+	cleared bool
+}
+
+// update runs fn in a transaction over a store, and then passes the changes it made, in
+// order of location, to commit, which must apply them all at once or not at all.
+func update(store RWCache, fn func(tx RWCache) error, commit func(changes []change) error) error {
+	var view RWCache
+	if f, ok := store.(Forker); ok {
+		var err error
+		if view, err = f.Fork(); err != nil && !errors.Is(err, ErrForksUnsupported) {
+			return err
+		}
+	}
+	if view == nil {
+		view = NewUnionedLayers(NewInMemoryCache(), store)
+	}
+
+	t := &txn{RWCache: view, changes: map[string]*change{}}
+	if err := fn(t); err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.cleared {
+		return ErrClearedInTransaction
+	}
+	changes := make([]change, 0, len(t.changes))
+	for _, c := range t.changes {
+		changes = append(changes, *c)
+	}
+	slices.SortFunc(changes, func(a, b change) int {
+		return strings.Compare(a.location, b.location)
+	})
+	return commit(changes)
+}
+
+// checkChanges checks the version of every object changed by a transaction against the
+// current version, given by current.
+func checkChanges(changes []change, current func(location string) uint64) error {
+	for _, c := range changes {
+		if err := checkVersion(c.location, current(c.location), c.version); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stage records a change to an object, once it has been made in the view by apply.  The
+// version is only recorded the first time an object is changed.
+func (t *txn) stage(location string, deleted bool, data []byte, apply func() error) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c, ok := t.changes[location]
+	if !ok {
+		c = &change{location: location}
+		if meta, err := t.RWCache.Stat(location); err == nil {
+			c.version = meta.Version
+		}
+	}
+	if err := apply(); err != nil {
+		return err
+	}
+	c.deleted, c.data = deleted, data
+	t.changes[location] = c
+	return nil
+}
+
+// Clear only marks the transaction as failed, since it cannot be staged.
+func (t *txn) Clear() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.cleared = true
+}
+
+// Reset only marks the transaction as failed, since it cannot be staged.
+func (t *txn) Reset() {
+	t.Clear()
+}
+
+func (t *txn) Write(location string, data []byte) error {
+	return t.stage(location, false, data, func() error {
+		return t.RWCache.Write(location, data)
+	})
+}
+
+func (t *txn) WriteIf(location string, data []byte, version uint64) error {
+	return t.stage(location, false, data, func() error {
+		return t.RWCache.WriteIf(location, data, version)
+	})
+}
+
+func (t *txn) Delete(location string) bool {
+	return t.stage(location, true, nil, func() error {
+		if !t.RWCache.Delete(location) {
+			return newError(location, ErrObjectNotFound)
+		}
+		return nil
+	}) == nil
+}
+
+func (t *txn) DeleteIf(location string, version uint64) error {
+	return t.stage(location, true, nil, func() error {
+		return t.RWCache.DeleteIf(location, version)
+	})
+}
+
+// DeleteTree stages a delete for every object in the tree, so a transaction never hides
+// objects written beneath the prefix by anyone else.
+func (t *txn) DeleteTree(location string) bool {
+	object, prefix := treePrefix(location)
+	if prefix == "/" {
+		return false
+	}
+	locations, _ := t.RWCache.ListTree(prefix, 0)
+	if object != "" {
+		locations = append(locations, object)
+	}
+
+	var ok bool
+	for _, key := range locations {
+		ok = t.Delete(key) || ok
+	}
+	return ok
+}
@@ -2,52 +2,175 @@ package storage
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"path"
+	"slices"
 	"strings"
+	"sync"
+	"time"
 )
 
+// UnionedCache overlays a writable layer on top of any number of read-only layers.
+// Reads are resolved from the topmost layer that has an object, writes always go to
+// the writable layer, and deleting an object in a lower layer leaves a hole that hides it.
+// Deleting a tree leaves a whiteout that hides every location beneath its prefix in the
+// lower layers, while still showing anything written to the writable layer afterwards.
+// Holes and whiteouts are kept in persistent trees, so that forks and snapshots share them.
 type UnionedCache struct {
-	cache map[string]record
-	base  RCache
-	temp  RWCache
+	mu          sync.RWMutex
+	gen         uint64
+	cache       map[string]record
+	holes       *tree
+	whiteouts   *tree
+	layers      []RCache
+	temp        RWCache
+	clock       Clock
+	checkpoints checkpoints
+	watchers    watchers
+	expiries    expiries
 }
 
+// NewUnionedCache creates an in-memory writable layer on top of a fixture directory.
 func NewUnionedCache(fixtureDir string) *UnionedCache {
+	return NewUnionedLayers(NewInMemoryCache(), NewFixtureStorage(fixtureDir))
+}
+
+// NewUnionedLayers stacks the given read-only layers beneath the writable temp layer.
+// Layers are ordered from the bottom up, so later layers hide earlier ones.
+func NewUnionedLayers(temp RWCache, layers ...RCache) *UnionedCache {
+	all := make([]RCache, 0, len(layers)+1)
+	all = append(all, layers...)
+	all = append(all, temp)
 	return &UnionedCache{
-		cache: map[string]record{},
-		base:  NewFixtureStorage(fixtureDir),
-		temp:  NewInMemoryCache(),
+		cache:  map[string]record{},
+		layers: all,
+		temp:   temp,
+		clock:  SystemClock,
 	}
 }
 
+// Watch reports changes made through this UnionedCache, but not any made directly to its
+// layers.
+func (u *UnionedCache) Watch(ctx context.Context, prefix string) <-chan Event {
+	return u.watchers.watch(ctx, prefix)
+}
+
 func (u *UnionedCache) Clear() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.gen++
 	u.cache = map[string]record{}
-	u.base.Clear()
-	u.temp.Clear()
+	u.holes, u.whiteouts = nil, nil
+	u.expiries = expiries{}
+	for _, layer := range u.layers {
+		layer.Clear()
+	}
 }
 
 func (u *UnionedCache) Reset() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.gen++
 	u.cache = map[string]record{}
+	u.holes, u.whiteouts = nil, nil
+	u.expiries = expiries{}
 	u.temp.Clear()
 }
 
+func (u *UnionedCache) top() int {
+	return len(u.layers) - 1
+}
+
+// lookup returns a cached record, along with the generation it was read at, and the
+// lowest layer that may be searched for the location, given any whiteouts.
+func (u *UnionedCache) lookup(location string) (r record, ok bool, gen uint64, bottom int) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	r, ok = u.cached(location)
+	return r, ok, u.gen, u.bottom(location)
+}
+
+// cached returns the cached record for a location, which is a hole if there is one.  It
+// must be called with a lock held.
+func (u *UnionedCache) cached(location string) (record, bool) {
+	if _, ok := u.holes.get(location); ok {
+		return holeRecord{}, true
+	}
+	r, ok := u.cache[location]
+	return r, ok
+}
+
+// link records an object written to the writable layer, replacing any hole.  It must be
+// called with the write lock held.
+func (u *UnionedCache) link(location string) {
+	u.holes, _ = u.holes.remove(location)
+	u.cache[location] = linkRecord{layer: u.top(), location: location}
+}
+
+// hole hides an object in the lower layers.  It must be called with the write lock held.
+func (u *UnionedCache) hole(location string) {
+	delete(u.cache, location)
+	u.holes = u.holes.insert(location, objectRecord{})
+}
+
+// forget removes any cached record or hole for a location.  It must be called with the
+// write lock held.
+func (u *UnionedCache) forget(location string) {
+	delete(u.cache, location)
+	u.holes, _ = u.holes.remove(location)
+}
+
+// bottom returns the lowest layer that may be searched for a location, which is only the
+// writable layer if the location is beneath a whiteout.  It must be called with a lock held.
+func (u *UnionedCache) bottom(location string) int {
+	if u.whiteouts != nil {
+		prefix := location
+		if !strings.HasSuffix(prefix, "/") {
+			prefix = path.Dir(prefix) + "/"
+		}
+		for ; prefix != "./" && prefix != "/"; prefix = path.Dir(strings.TrimSuffix(prefix, "/")) + "/" {
+			if _, ok := u.whiteouts.get(prefix); ok {
+				return u.top()
+			}
+		}
+	}
+	return 0
+}
+
+// remember caches a record that was computed outside the lock, unless a write
+// has happened since gen was read, in which case the record may be stale.
+func (u *UnionedCache) remember(gen uint64, location string, r record) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.gen == gen {
+		u.cache[location] = r
+	}
+}
+
 func (u *UnionedCache) readFrom(link linkRecord) ([]byte, error) {
-	switch link.layer {
-	case 0:
-		return u.base.Read(link.location)
-	case 1:
-		return u.temp.Read(link.location)
-	default:
+	if link.layer < 0 || link.layer > u.top() {
 		return nil, wrapFailure(fmt.Errorf("readFrom: no such layer %d", link.layer), link.location)
 	}
+	return u.layers[link.layer].Read(link.location)
+}
+
+func (u *UnionedCache) statFrom(link linkRecord) (Metadata, error) {
+	if link.layer < 0 || link.layer > u.top() {
+		return Metadata{}, wrapFailure(fmt.Errorf("statFrom: no such layer %d", link.layer), link.location)
+	}
+	return u.layers[link.layer].Stat(link.location)
 }
 
 func (u *UnionedCache) Read(location string) (data []byte, err error) {
 	if strings.HasSuffix(location, "/") {
-		err = newError(location, ErrLocationNotObject)
-	} else if r, ok := u.cache[location]; ok {
+		return nil, newError(location, ErrLocationNotObject)
+	}
+
+	u.reap()
+	r, ok, gen, bottom := u.lookup(location)
+	if ok {
 		switch r.kind() {
 		case kindHole:
 			err = newError(location, ErrObjectNotFound)
@@ -56,137 +179,680 @@ func (u *UnionedCache) Read(location string) (data []byte, err error) {
 		default:
 			err = wrapFailure(errors.New("not a link or hole record"), location)
 		}
-	} else if data, err = u.temp.Read(location); err == nil {
-		u.cache[location] = linkRecord{layer: 1, location: location}
-	} else if data, err = u.base.Read(location); err == nil {
-		u.cache[location] = linkRecord{layer: 0, location: location}
+		return
+	}
+
+	// Search from the top down, stopping at the first layer that has it or fails.
+	for layer := u.top(); layer >= bottom; layer-- {
+		if data, err = u.layers[layer].Read(location); err == nil {
+			u.remember(gen, location, linkRecord{layer: layer, location: location})
+			return
+		} else if !IsObjectNotFound(err) {
+			return
+		}
 	}
 	return
 }
 
+// Stat describes an object using the metadata of the topmost layer that has it.
+func (u *UnionedCache) Stat(location string) (meta Metadata, err error) {
+	if strings.HasSuffix(location, "/") {
+		return meta, newError(location, ErrLocationNotObject)
+	}
+
+	u.reap()
+	r, ok, gen, bottom := u.lookup(location)
+	if ok {
+		switch r.kind() {
+		case kindHole:
+			err = newError(location, ErrObjectNotFound)
+		case kindLink:
+			meta, err = u.statFrom(r.(linkRecord))
+		default:
+			err = wrapFailure(errors.New("not a link or hole record"), location)
+		}
+		return
+	}
+
+	// Search from the top down, stopping at the first layer that has it or fails.
+	for layer := u.top(); layer >= bottom; layer-- {
+		if meta, err = u.layers[layer].Stat(location); err == nil {
+			u.remember(gen, location, linkRecord{layer: layer, location: location})
+			return
+		} else if !IsObjectNotFound(err) {
+			return
+		}
+	}
+	return
+}
+
+// SetClock sets the clock used to expire objects, along with the clock of the writable
+// layer, if it has one.
+func (u *UnionedCache) SetClock(clock Clock) {
+	u.mu.Lock()
+	u.clock = clock
+	u.mu.Unlock()
+	if temp, ok := u.temp.(Clocked); ok {
+		temp.SetClock(clock)
+	}
+}
+
 func (u *UnionedCache) Exists(location string) bool {
-	if r, ok := u.cache[location]; ok {
+	u.reap()
+	r, ok, gen, bottom := u.lookup(location)
+	if ok {
 		return r.kind() == kindLink
-	} else if u.temp.Exists(location) {
-		u.cache[location] = linkRecord{layer: 1, location: location}
-	} else if u.base.Exists(location) {
-		u.cache[location] = linkRecord{layer: 0, location: location}
-	} else {
-		return false
 	}
-	return true
+	if link, ok := u.resolve(location, u.top(), bottom); ok {
+		u.remember(gen, location, link)
+		return true
+	}
+	return false
+}
+
+// resolve finds the topmost layer, from the given layer down to the bottom layer,
+// containing an object, ignoring the cache.
+func (u *UnionedCache) resolve(location string, from, bottom int) (linkRecord, bool) {
+	for layer := from; layer >= bottom; layer-- {
+		if u.layers[layer].Exists(location) {
+			return linkRecord{layer: layer, location: location}, true
+		}
+	}
+	return linkRecord{}, false
 }
 
 func (u *UnionedCache) List(location string) (subkeys []string, err error) {
 	if !strings.HasSuffix(location, "/") {
-		err = newError(location, ErrLocationNotPrefix)
-	} else if r, ok := u.cache[location]; ok {
+		return nil, newError(location, ErrLocationNotPrefix)
+	}
+
+	u.reap()
+	r, ok, gen, bottom := u.lookup(location)
+	if ok {
 		if r.kind() != kindCollection {
 			err = newError(location, ErrKindNotPrefix)
 		} else {
 			subkeys = r.(collectionRecord).subkeys
 		}
-	} else {
-		var basekeys, tempkeys []string
-		var baseerr error
-		basekeys, baseerr = u.base.List(location)
-		tempkeys, err = u.temp.List(location)
+		return
+	}
+
+	subkeys, err = u.listLayers(bottom, func(layer RCache) ([]string, error) {
+		return layer.List(location)
+	})
+	if err == nil {
+		u.remember(gen, location, collectionRecord{subkeys: subkeys})
+	}
+	return
+}
+
+func (u *UnionedCache) ListTree(location string, depth int) ([]string, error) {
+	if location != "" && !strings.HasSuffix(location, "/") {
+		return nil, newError(location, ErrLocationNotPrefix)
+	} else if depth == 1 && location != "" {
+		return u.List(location)
+	}
 
-		if (baseerr == nil && (err == nil || IsPrefixNotFound(err))) ||
-			(err == nil && (baseerr == nil || IsPrefixNotFound(baseerr))) {
+	u.reap()
+	_, _, _, bottom := u.lookup(location)
+	return u.listLayers(bottom, func(layer RCache) ([]string, error) {
+		return layer.ListTree(location, depth)
+	})
+}
 
-			subkeys = make([]string, 0, len(basekeys)+len(tempkeys))
-			subkeys = append(subkeys, basekeys...)
-			subkeys = append(subkeys, tempkeys...)
-			u.cache[location] = collectionRecord{subkeys: subkeys}
+// listLayers lists keys from every layer, down to the bottom layer, and merges them.
+func (u *UnionedCache) listLayers(bottom int, list func(layer RCache) ([]string, error)) ([]string, error) {
+	layerkeys, err := u.gather(bottom, list)
+	if err != nil {
+		return nil, err
+	}
 
-			err = nil
-		} else if err == nil {
-			err = baseerr
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.merge(layerkeys...), nil
+}
+
+// gather lists keys from every layer, down to the bottom layer.
+func (u *UnionedCache) gather(bottom int, list func(layer RCache) ([]string, error)) ([][]string, error) {
+	// A prefix only needs to be found in one layer, but any other failure is fatal.
+	var missing error
+	layerkeys := make([][]string, 0, len(u.layers))
+	for layer := u.top(); layer >= bottom; layer-- {
+		keys, err := list(u.layers[layer])
+		if err == nil {
+			layerkeys = append(layerkeys, keys)
+		} else if !IsPrefixNotFound(err) {
+			return nil, err
+		} else if missing == nil {
+			missing = err
 		}
 	}
-	return
+	if len(layerkeys) == 0 {
+		return nil, missing
+	}
+	return layerkeys, nil
+}
+
+// merge combines keys from each layer into a sorted list without duplicates, leaving out
+// any keys that have been hidden by holes or whiteouts.  It must be called with a lock held.
+func (u *UnionedCache) merge(layerkeys ...[]string) []string {
+	var n int
+	for _, keys := range layerkeys {
+		n += len(keys)
+	}
+	subkeys := make([]string, 0, n)
+	for _, keys := range layerkeys {
+		subkeys = append(subkeys, keys...)
+	}
+	slices.Sort(subkeys)
+	return u.hide(slices.Compact(subkeys))
+}
+
+// hide leaves out any keys that have been hidden by holes or whiteouts.  It must be called
+// with a lock held.
+func (u *UnionedCache) hide(subkeys []string) []string {
+	return slices.DeleteFunc(subkeys, func(key string) bool {
+		if r, ok := u.cached(key); ok {
+			return r.kind() == kindHole
+		}
+		return u.bottom(key) == u.top() && !u.temp.Exists(key)
+	})
+}
+
+// ReadPage reads a page while holding the read lock, so that it never holds part of a
+// transaction.
+func (u *UnionedCache) ReadPage(location string, options PageOptions) (*Page, error) {
+	if !strings.HasSuffix(location, "/") {
+		return nil, newError(location, ErrLocationNotPrefix)
+	}
+
+	u.reap()
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	subkeys, err := u.list(location)
+	if err != nil {
+		return nil, err
+	}
+	return readPage(location, subkeys, options, u.read)
 }
 
+// ReadList builds a list while holding the read lock, so that it never holds part of a
+// transaction.
 func (u *UnionedCache) ReadList(location string) ([]byte, error) {
 	if !strings.HasSuffix(location, "/") {
 		return nil, newError(location, ErrLocationNotPrefix)
 	}
 
-	// Hydrate the file list if the data is not cached.
-	var subkeys []string
-	var err error
-	if r, ok := u.cache[location]; !ok {
-		subkeys, err = u.List(location)
-		if err != nil {
-			return nil, err
-		}
-	} else if r.kind() != kindCollection {
-		return nil, newError(location, ErrKindNotPrefix)
-	} else if r.(collectionRecord).data != nil {
-		return r.(collectionRecord).data, nil
-	} else {
-		subkeys = r.(collectionRecord).subkeys
+	u.reap()
+	list, cached, gen, err := u.readList(location)
+	if err != nil {
+		return nil, err
+	} else if !cached {
+		u.remember(gen, location, list)
+	}
+	return list.data, nil
+}
+
+// readList returns the record for a list, along with whether it was already cached, and
+// the generation it was built at.
+func (u *UnionedCache) readList(location string) (list collectionRecord, cached bool, gen uint64, err error) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	if r, ok := u.cache[location]; ok && r.kind() == kindCollection && r.(collectionRecord).data != nil {
+		return r.(collectionRecord), true, u.gen, nil
+	}
+
+	subkeys, err := u.list(location)
+	if err != nil {
+		return list, false, u.gen, err
 	}
 
 	// Build an object record for this collection.
 	buff := bytes.Buffer{}
 	buff.WriteString("[")
-	for i, subkey := range subkeys {
-		if i > 0 {
-			buff.WriteString(",")
+	for _, subkey := range subkeys {
+		data, err := u.read(subkey)
+		if IsObjectNotFound(err) {
+			continue
+		} else if err != nil {
+			return list, false, u.gen, err
 		}
-		data, err := u.Read(subkey)
-		if err != nil {
-			return nil, err
+		if buff.Len() > 1 {
+			buff.WriteString(",")
 		}
 		buff.Write(data)
 	}
 	buff.WriteString("]")
+	return collectionRecord{data: buff.Bytes(), subkeys: subkeys}, false, u.gen, nil
+}
 
-	// Cache the result and return it
-	b := buff.Bytes()
-	u.cache[location] = collectionRecord{data: b, subkeys: subkeys}
-	return b, nil
+// list lists the objects directly beneath a prefix, like List, without caching them.  It
+// must be called with a lock held.
+func (u *UnionedCache) list(location string) ([]string, error) {
+	if r, ok := u.cache[location]; ok {
+		if r.kind() != kindCollection {
+			return nil, newError(location, ErrKindNotPrefix)
+		}
+		return r.(collectionRecord).subkeys, nil
+	}
+	layerkeys, err := u.gather(u.bottom(location), func(layer RCache) ([]string, error) {
+		return layer.List(location)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return u.merge(layerkeys...), nil
 }
 
-func (u *UnionedCache) Write(location string, data []byte) (err error) {
-	if strings.HasSuffix(location, "/") {
-		err = newError(location, ErrLocationNotObject)
-	} else if err = u.temp.Write(location, data); err == nil {
-		// Record the link
-		if _, ok := u.cache[location]; !ok {
-			u.cache[location] = linkRecord{layer: 1, location: location}
+// read reads an object, like Read, without caching the layer it was found in.  It must
+// be called with a lock held.
+func (u *UnionedCache) read(location string) ([]byte, error) {
+	if r, ok := u.cached(location); ok {
+		switch r.kind() {
+		case kindHole:
+			return nil, newError(location, ErrObjectNotFound)
+		case kindLink:
+			return u.readFrom(r.(linkRecord))
+		default:
+			return nil, wrapFailure(errors.New("not a link or hole record"), location)
 		}
+	}
+	for layer := u.top(); layer >= u.bottom(location); layer-- {
+		if data, err := u.layers[layer].Read(location); !IsObjectNotFound(err) {
+			return data, err
+		}
+	}
+	return nil, newError(location, ErrObjectNotFound)
+}
+
+func (u *UnionedCache) Write(location string, data []byte) error {
+	if strings.HasSuffix(location, "/") {
+		return newError(location, ErrLocationNotObject)
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.expire()
+	return u.write(location, data)
+}
+
+func (u *UnionedCache) WriteIf(location string, data []byte, version uint64) error {
+	if strings.HasSuffix(location, "/") {
+		return newError(location, ErrLocationNotObject)
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.expire()
+	if err := checkVersion(location, u.current(location), version); err != nil {
+		return err
+	}
+	return u.write(location, data)
+}
+
+// current returns the version of an object in the topmost layer that has it, or 0 if
+// there is no such object.  It must be called with the write lock held.
+func (u *UnionedCache) current(location string) uint64 {
+	r, ok := u.cached(location)
+	if !ok {
+		r, ok = u.resolve(location, u.top(), u.bottom(location))
+	}
+	if !ok || r.kind() != kindLink {
+		return 0
+	}
+	meta, err := u.statFrom(r.(linkRecord))
+	if err != nil {
+		return 0
+	}
+	return meta.Version
+}
+
+// advancer is implemented by writable layers whose versions can be advanced, so that an
+// object written over one from a lower layer gets a greater version than it replaced.
+type advancer interface {
+	advance(floor uint64)
+}
+
+// write must be called with the write lock held.
+func (u *UnionedCache) write(location string, data []byte) (err error) {
+	replaced := u.current(location)
+	if temp, ok := u.temp.(advancer); ok && replaced != 0 {
+		temp.advance(replaced)
+	}
+	if err = u.temp.Write(location, data); err == nil {
+		u.gen++
+
+		// Record the link, replacing any link or hole into a lower layer
+		u.link(location)
+		u.expiries.remove(location)
 
 		// Invalidate any cached list
 		if parent := path.Dir(location); parent != "." {
 			delete(u.cache, parent+"/")
 		}
+
+		if u.watchers.active() {
+			u.watchers.written(location, data, u.current(location), replaced != 0)
+		}
 	}
 	return
 }
 
+// WriteTTL writes an object to the writable layer, which expires once ttl has passed on the
+// UnionedCache's clock, leaving a hole if there is still an object in a lower layer.
+func (u *UnionedCache) WriteTTL(location string, data []byte, ttl time.Duration) error {
+	if strings.HasSuffix(location, "/") {
+		return newError(location, ErrLocationNotObject)
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.expire()
+	if err := u.write(location, data); err != nil {
+		return err
+	}
+	u.expiries.set(location, u.clock.Now().Add(ttl))
+	return nil
+}
+
+// reap deletes any objects that have expired, before reading.
+func (u *UnionedCache) reap() {
+	u.mu.RLock()
+	due := u.expiries.due(u.clock.Now())
+	u.mu.RUnlock()
+	if due {
+		u.mu.Lock()
+		defer u.mu.Unlock()
+		u.expire()
+	}
+}
+
+// expire deletes any objects that have expired.  It must be called with the write lock held.
+func (u *UnionedCache) expire() {
+	if now := u.clock.Now(); u.expiries.due(now) {
+		for _, location := range u.expiries.take(now) {
+			u.delete(location)
+		}
+	}
+}
+
 func (u *UnionedCache) Delete(location string) bool {
-	if strings.HasSuffix(location, "/") || !u.Exists(location) {
+	if strings.HasSuffix(location, "/") {
 		return false
 	}
 
-	var ok = true
-	switch u.cache[location].(linkRecord).layer {
-	case 0:
-		u.cache[location] = holeRecord{}
-	case 1:
-		ok = u.temp.Delete(location)
-		delete(u.cache, location)
-	default:
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.expire()
+	return u.delete(location)
+}
+
+func (u *UnionedCache) DeleteIf(location string, version uint64) error {
+	if strings.HasSuffix(location, "/") {
+		return newError(location, ErrLocationNotObject)
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.expire()
+	if err := checkDelete(location, u.current(location), version); err != nil {
+		return err
+	}
+	u.delete(location)
+	return nil
+}
+
+// delete must be called with the write lock held.
+func (u *UnionedCache) delete(location string) bool {
+	r, ok := u.cached(location)
+	if !ok {
+		if r, ok = u.resolve(location, u.top(), u.bottom(location)); !ok {
+			return false
+		}
+	} else if r.kind() != kindLink {
 		return false
 	}
 
+	ok = true
+	switch layer := r.(linkRecord).layer; {
+	case layer < 0 || layer > u.top():
+		return false
+	case layer < u.top():
+		u.hole(location)
+	default:
+		// Leave a hole if there is still an object in a lower layer to hide
+		ok = u.temp.Delete(location)
+		if _, below := u.resolve(location, layer-1, u.bottom(location)); below {
+			u.hole(location)
+		} else {
+			u.forget(location)
+		}
+	}
+	u.gen++
+
 	// Invalidate any cached list
 	if parent := path.Dir(location); parent != "." {
 		delete(u.cache, parent+"/")
 	}
 
+	if ok {
+		u.watchers.deleted(location)
+	}
+	u.expiries.remove(location)
 	return ok
 }
+
+func (u *UnionedCache) DeleteTree(location string) bool {
+	object, prefix := treePrefix(location)
+	if prefix == "/" {
+		return false
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.expire()
+
+	// List the objects that can be seen in the tree before deleting it, both to report
+	// them and to tell whether anything existed
+	deleted := u.tree(object, prefix)
+
+	// Delete the tree from the writable layer, then hide whatever remains below it
+	u.temp.DeleteTree(location)
+	var below bool
+	if object != "" {
+		_, below = u.resolve(object, u.top()-1, u.bottom(object))
+	}
+	if u.bottom(prefix) < u.top() {
+		u.whiteouts = u.whiteouts.insert(prefix, objectRecord{})
+	}
+	u.gen++
+
+	// Invalidate the tree, since the whiteout replaces any holes within it, along with
+	// every cached list, since lists may include nested objects
+	for key, r := range u.cache {
+		if r.kind() == kindCollection || inTree(key, object, prefix) {
+			delete(u.cache, key)
+		}
+	}
+	var holes []string
+	u.holes.ascend(prefix, func(key string, _ objectRecord) bool {
+		holes = append(holes, key)
+		return strings.HasPrefix(key, prefix)
+	})
+	for _, key := range append(holes, object) {
+		if inTree(key, object, prefix) {
+			u.holes, _ = u.holes.remove(key)
+		}
+	}
+	if below {
+		u.hole(object)
+	}
+	u.expiries.removeTree(object, prefix)
+
+	for _, key := range deleted {
+		u.watchers.deleted(key)
+	}
+	return len(deleted) > 0
+}
+
+// tree lists every object in a tree, from every layer, without caching anything.  It must
+// be called with the write lock held.
+func (u *UnionedCache) tree(object, prefix string) []string {
+	var subkeys []string
+	for layer := u.top(); layer >= u.bottom(prefix); layer-- {
+		keys, _ := u.layers[layer].ListTree(prefix, 0)
+		subkeys = append(subkeys, keys...)
+	}
+	slices.Sort(subkeys)
+	subkeys = u.hide(slices.Compact(subkeys))
+	if object != "" && u.current(object) != 0 {
+		subkeys = append(subkeys, object)
+	}
+	return subkeys
+}
+
+func (u *UnionedCache) Update(fn func(tx RWCache) error) error {
+	return update(u, fn, u.commit)
+}
+
+// commit applies a transaction's changes to the writable layer, all at once if it is also
+// a Transactor, and then updates the holes hiding lower layers, while holding the write
+// lock.
+func (u *UnionedCache) commit(changes []change) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.expire()
+	if err := checkChanges(changes, u.current); err != nil {
+		return err
+	}
+	if temp, ok := u.temp.(advancer); ok {
+		for _, c := range changes {
+			temp.advance(c.version)
+		}
+	}
+
+	apply := func(temp RWCache) error {
+		for _, c := range changes {
+			if c.deleted {
+				temp.Delete(c.location)
+			} else if err := temp.Write(c.location, c.data); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	var err error
+	if temp, ok := u.temp.(Transactor); ok {
+		err = temp.Update(apply)
+	} else {
+		err = apply(u.temp)
+	}
+	if err != nil {
+		return err
+	}
+	u.gen++
+
+	for _, c := range changes {
+		u.expiries.remove(c.location)
+		if !c.deleted {
+			u.link(c.location)
+		} else if _, below := u.resolve(c.location, u.top()-1, u.bottom(c.location)); below {
+			u.hole(c.location)
+		} else {
+			u.forget(c.location)
+		}
+
+		// Invalidate any cached list
+		if parent := path.Dir(c.location); parent != "." {
+			delete(u.cache, parent+"/")
+		}
+	}
+
+	if u.watchers.active() {
+		for _, c := range changes {
+			if c.deleted {
+				u.watchers.deleted(c.location)
+			} else {
+				u.watchers.written(c.location, c.data, u.current(c.location), c.version != 0)
+			}
+		}
+	}
+	return nil
+}
+
+// Snapshot saves the holes and whiteouts hiding lower layers, along with the contents of
+// the writable layer, which must also be a Snapshotter.
+func (u *UnionedCache) Snapshot() (*Snapshot, error) {
+	temp, ok := u.temp.(Snapshotter)
+	if !ok {
+		return nil, ErrSnapshotsUnsupported
+	}
+
+	// Block writers, so that the holes and the writable layer are consistent.
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	layer, err := temp.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &Snapshot{
+		holes:     u.holes,
+		whiteouts: u.whiteouts,
+		expiries:  u.expiries.clone(),
+		layer:     layer,
+	}, nil
+}
+
+func (u *UnionedCache) Restore(snapshot *Snapshot) error {
+	temp, ok := u.temp.(Snapshotter)
+	if !ok {
+		return ErrSnapshotsUnsupported
+	} else if snapshot == nil {
+		return ErrNoSnapshot
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if err := temp.Restore(snapshot.layer); err != nil {
+		return err
+	}
+	u.gen++
+	u.cache = map[string]record{}
+	u.holes, u.whiteouts = snapshot.holes, snapshot.whiteouts
+	u.expiries = snapshot.expiries.clone()
+	return nil
+}
+
+func (u *UnionedCache) PushCheckpoint() error {
+	return u.checkpoints.push(u.Snapshot())
+}
+
+func (u *UnionedCache) RollbackCheckpoint() error {
+	return u.checkpoints.restore(u, false)
+}
+
+func (u *UnionedCache) PopCheckpoint() error {
+	return u.checkpoints.restore(u, true)
+}
+
+// Fork returns a new UnionedCache over the same read-only layers, with a fork of the
+// writable layer, which must also be a Forker.  The fork shares the holes and whiteouts.
+func (u *UnionedCache) Fork() (RWCache, error) {
+	temp, ok := u.temp.(Forker)
+	if !ok {
+		return nil, ErrForksUnsupported
+	}
+
+	// Block writers, so that the holes and the writable layer are consistent.
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	forked, err := temp.Fork()
+	if err != nil {
+		return nil, err
+	}
+	f := NewUnionedLayers(forked, u.layers[:u.top()]...)
+	f.holes, f.whiteouts = u.holes, u.whiteouts
+	f.clock = u.clock
+	f.expiries = u.expiries.clone()
+	return f, nil
+}
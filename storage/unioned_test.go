@@ -1,8 +1,12 @@
 package storage_test
 
 import (
+	"context"
+	"fmt"
 	"os"
 	"path"
+	"sync"
+	"time"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
@@ -11,6 +15,17 @@ import (
 	"github/joekhoobyar/epigon/test"
 )
 
+// pausedLayer calls pause before reading each object from the layer it wraps.
+type pausedLayer struct {
+	storage.RCache
+	pause func(location string)
+}
+
+func (p *pausedLayer) Read(location string) ([]byte, error) {
+	p.pause(location)
+	return p.RCache.Read(location)
+}
+
 var _ = Describe("UnionedCache", func() {
 	var root, child1, child2 []byte
 	var err error
@@ -84,6 +99,18 @@ var _ = Describe("UnionedCache", func() {
 				Expect(u.ReadList("root/child2/nest/")).To(Equal([]byte("[]")))
 			})
 		})
+
+		Context("that have overridden or deleted children", func() {
+			It("should load overridden children once", func() {
+				err = u.Write("root/child1", []byte("{\"name\":\"teen\"}"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(u.ReadList("root/")).To(Equal([]byte("[{\"name\":\"teen\"},{\"name\":\"kid\"}]")))
+			})
+			It("should leave out deleted children", func() {
+				Expect(u.Delete("root/child1")).To(BeTrue())
+				Expect(u.ReadList("root/")).To(Equal([]byte("[{\"name\":\"kid\"}]")))
+			})
+		})
 	})
 
 	Describe("Listing fixture keys", func() {
@@ -108,6 +135,269 @@ var _ = Describe("UnionedCache", func() {
 			It("should load empty lists", func() {
 				Expect(u.List("root/child2/nest/")).To(Equal([]string{}))
 			})
+			It("should sort children from both layers", func() {
+				err = u.Write("root/adopted", []byte("{\"name\":\"newbie\"}"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(u.List("root/")).To(Equal([]string{"root/adopted", "root/child1", "root/child2"}))
+			})
+		})
+
+		Context("that have overridden or deleted children", func() {
+			It("should list overridden children once", func() {
+				err = u.Write("root/child1", []byte("{\"name\":\"teen\"}"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(u.List("root/")).To(Equal([]string{"root/child1", "root/child2"}))
+			})
+			It("should leave out deleted children", func() {
+				Expect(u.Delete("root/child1")).To(BeTrue())
+				Expect(u.List("root/")).To(Equal([]string{"root/child2"}))
+			})
+			It("should leave out deleted children that were overridden", func() {
+				err = u.Write("root/child1", []byte("{\"name\":\"teen\"}"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(u.Delete("root/child1")).To(BeTrue())
+				Expect(u.List("root/")).To(Equal([]string{"root/child2"}))
+				Expect(u.Exists("root/child1")).To(BeFalse())
+			})
+			It("should list deleted children that were rewritten", func() {
+				Expect(u.Delete("root/child1")).To(BeTrue())
+				err = u.Write("root/child1", []byte("{\"name\":\"teen\"}"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(u.List("root/")).To(Equal([]string{"root/child1", "root/child2"}))
+				Expect(u.Read("root/child1")).To(Equal([]byte("{\"name\":\"teen\"}")))
+			})
+		})
+
+		Context("that are trees", func() {
+			It("should combine nested subkeys from both layers", func() {
+				Expect(u.Write("root/child1/nest/hand", []byte("\"hand\""))).To(Succeed())
+				Expect(u.List("root/")).To(Equal([]string{"root/child1", "root/child2"}))
+				Expect(u.ListTree("root/", 0)).To(Equal([]string{"root/child1", "root/child1/nest/arm",
+					"root/child1/nest/hand", "root/child1/nest/leg", "root/child2"}))
+				Expect(u.ListTree("root/", 2)).To(Equal([]string{"root/child1", "root/child2"}))
+			})
+			It("should leave out nested subkeys hidden by holes and whiteouts", func() {
+				Expect(u.Delete("root/child1/nest/arm")).To(BeTrue())
+				Expect(u.ListTree("root/", 0)).To(Equal([]string{"root/child1", "root/child1/nest/leg", "root/child2"}))
+				Expect(u.DeleteTree("root/child1/")).To(BeTrue())
+				Expect(u.Write("root/child1/nest/hand", []byte("\"hand\""))).To(Succeed())
+				Expect(u.ListTree("root/", 0)).To(Equal([]string{"root/child1", "root/child1/nest/hand", "root/child2"}))
+			})
+		})
+	})
+
+	Describe("Metadata", func() {
+		It("should describe fixtures by their file", func() {
+			info, err := os.Stat(path.Join(dir, "root/child1.json"))
+			Expect(err).NotTo(HaveOccurred())
+			meta, err := u.Stat("root/child1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(meta.Updated).To(Equal(info.ModTime()))
+			Expect(meta.Size).To(Equal(len(child1)))
+		})
+		It("should describe objects in the writable layer", func() {
+			clock := storage.NewManualClock(time.Date(2024, 2, 20, 12, 0, 0, 0, time.UTC))
+			u.SetClock(clock)
+			DeferCleanup(u.SetClock, storage.SystemClock)
+			fixture, err := u.Stat("root/child1")
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(u.Write("root/child1", child2)).To(Succeed())
+			meta, err := u.Stat("root/child1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(meta.Updated).To(Equal(clock.Now()))
+			Expect(meta.Version).To(BeNumerically(">", fixture.Version))
+		})
+		It("should give objects written over fixtures greater versions", func() {
+			fixture, err := u.Stat("root/child1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(u.Write("root/child1", child2)).To(Succeed())
+			written, err := u.Stat("root/child1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(written.Version).To(BeNumerically(">", fixture.Version))
+
+			fixture, err = u.Stat("root/child2")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(u.Update(func(tx storage.RWCache) error {
+				return tx.Write("root/child2", child1)
+			})).To(Succeed())
+			meta, err := u.Stat("root/child2")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(meta.Version).To(BeNumerically(">", fixture.Version))
+		})
+		It("should fail for deleted objects", func() {
+			Expect(u.Delete("root/child1")).To(BeTrue())
+			_, err = u.Stat("root/child1")
+			Expect(storage.IsObjectNotFound(err)).To(BeTrue())
+		})
+	})
+
+	Describe("Conditional writes", func() {
+		It("should check the version of read-only objects", func() {
+			meta, err := u.Stat("root/child1")
+			Expect(err).NotTo(HaveOccurred())
+			err = u.WriteIf("root/child1", child2, 0)
+			Expect(storage.IsVersionConflict(err)).To(BeTrue())
+			Expect(u.WriteIf("root/child1", child2, meta.Version)).To(Succeed())
+			err = u.WriteIf("root/child1", child1, meta.Version)
+			Expect(storage.IsVersionConflict(err)).To(BeTrue())
+			Expect(u.Read("root/child1")).To(Equal(child2))
+		})
+		It("should create objects hidden by holes", func() {
+			Expect(u.Delete("root/child1")).To(BeTrue())
+			Expect(u.WriteIf("root/child1", child2, 0)).To(Succeed())
+		})
+		It("should delete only if the version matches", func() {
+			meta, err := u.Stat("root/child2")
+			Expect(err).NotTo(HaveOccurred())
+			err = u.DeleteIf("root/child2", meta.Version+1)
+			Expect(storage.IsVersionConflict(err)).To(BeTrue())
+			Expect(u.DeleteIf("root/child2", meta.Version)).To(Succeed())
+			Expect(u.Exists("root/child2")).To(BeFalse())
+		})
+	})
+
+	Describe("Expiring objects", func() {
+		var clock *storage.ManualClock
+
+		BeforeEach(func() {
+			clock = storage.NewManualClock(time.Date(2024, 2, 20, 12, 0, 0, 0, time.UTC))
+			u.SetClock(clock)
+			DeferCleanup(u.SetClock, storage.SystemClock)
+		})
+
+		It("should delete objects once they expire", func() {
+			Expect(u.WriteTTL("root/child3", child1, time.Minute)).To(Succeed())
+			Expect(u.List("root/")).To(ContainElement("root/child3"))
+			clock.Advance(time.Minute)
+			Expect(u.Exists("root/child3")).To(BeFalse())
+			Expect(u.List("root/")).To(Equal([]string{"root/child1", "root/child2"}))
+		})
+		It("should hide read-only objects once they expire", func() {
+			Expect(u.WriteTTL("root/child1", child2, time.Minute)).To(Succeed())
+			Expect(u.Read("root/child1")).To(Equal(child2))
+			clock.Advance(time.Minute)
+			_, err = u.Read("root/child1")
+			Expect(storage.IsObjectNotFound(err)).To(BeTrue())
+		})
+	})
+
+	Describe("Transactions", func() {
+		var t storage.Transactor = u
+
+		It("should apply every change at once", func() {
+			Expect(u.List("root/")).To(HaveLen(2))
+			err = t.Update(func(tx storage.RWCache) error {
+				Expect(tx.Delete("root/child1")).To(BeTrue())
+				return tx.Write("root/child3", child1)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(u.Exists("root/child1")).To(BeFalse())
+			Expect(u.List("root/")).To(Equal([]string{"root/child2", "root/child3"}))
+			Expect(u.ReadList("root/")).To(Equal([]byte("[" + string(child2) + "," + string(child1) + "]")))
+		})
+		It("should apply nothing if it fails", func() {
+			err = t.Update(func(tx storage.RWCache) error {
+				Expect(tx.Delete("root/child1")).To(BeTrue())
+				Expect(tx.Write("root/child3", child1)).To(Succeed())
+				return tx.WriteIf("root/child2", child1, 0)
+			})
+			Expect(storage.IsVersionConflict(err)).To(BeTrue())
+			Expect(u.List("root/")).To(Equal([]string{"root/child1", "root/child2"}))
+		})
+		It("should apply nothing if another writer changed the same objects", func() {
+			err = t.Update(func(tx storage.RWCache) error {
+				Expect(tx.Write("root/child3", child1)).To(Succeed())
+				Expect(tx.Delete("root/child2")).To(BeTrue())
+				Expect(u.Delete("root/child2")).To(BeTrue())
+				return nil
+			})
+			Expect(storage.IsVersionConflict(err)).To(BeTrue())
+			Expect(u.Exists("root/child3")).To(BeFalse())
+		})
+		It("should never show part of a transaction in a list", func() {
+			reading, committed := make(chan struct{}), make(chan struct{})
+			lower := &pausedLayer{RCache: storage.NewFixtureStorage(dir), pause: func(location string) {
+				if location == "root/child1" {
+					close(reading)
+					select {
+					case <-committed:
+					case <-time.After(100 * time.Millisecond):
+					}
+				}
+			}}
+			v := storage.NewUnionedLayers(storage.NewInMemoryCache(), lower)
+
+			// Commit while the list is being read
+			go func() {
+				defer GinkgoRecover()
+				defer close(committed)
+				<-reading
+				Expect(v.Update(func(tx storage.RWCache) error {
+					Expect(tx.Write("root/child1", root)).To(Succeed())
+					return tx.Write("root/child2", root)
+				})).To(Succeed())
+			}()
+			list, err := v.ReadList("root/")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(list)).To(Equal("[" + string(child1) + "," + string(child2) + "]"))
+			Eventually(committed).Should(BeClosed())
+			Expect(v.ReadList("root/")).To(Equal([]byte("[" + string(root) + "," + string(root) + "]")))
+		})
+	})
+
+	Describe("Watching", func() {
+		It("should report changes to every layer", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			events := u.Watch(ctx, "root/")
+
+			Expect(u.Write("root/child1", child2)).To(Succeed())
+			Expect(u.Write("root/child3", child1)).To(Succeed())
+			tree, err := u.ListTree("root/", 0)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tree).To(ContainElement("root/child3"))
+			Expect(u.DeleteTree("root/")).To(BeTrue())
+
+			var e storage.Event
+			Eventually(events).Should(Receive(&e))
+			Expect(e.Type).To(Equal(storage.EventUpdated))
+			Expect(e.Data).To(Equal(child2))
+			Eventually(events).Should(Receive(&e))
+			Expect(e.Type).To(Equal(storage.EventCreated))
+			for _, location := range tree {
+				Eventually(events).Should(Receive(&e))
+				Expect(e).To(Equal(storage.Event{Type: storage.EventDeleted, Location: location}))
+			}
+		})
+		It("should only report deleting trees for objects that were there", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			Expect(u.Delete("root/child1/nest/arm")).To(BeTrue())
+			events := u.Watch(ctx, "root/")
+
+			Expect(u.DeleteTree("root/child1")).To(BeTrue())
+			var e storage.Event
+			Eventually(events).Should(Receive(&e))
+			Expect(e).To(Equal(storage.Event{Type: storage.EventDeleted, Location: "root/child1/nest/leg"}))
+			Eventually(events).Should(Receive(&e))
+			Expect(e).To(Equal(storage.Event{Type: storage.EventDeleted, Location: "root/child1"}))
+			Consistently(events).ShouldNot(Receive())
+		})
+	})
+
+	Describe("Paging lists", func() {
+		It("should page through children from both layers", func() {
+			Expect(u.Write("root/adopted", []byte("{\"name\":\"newbie\"}"))).To(Succeed())
+			Expect(u.Delete("root/child2")).To(BeTrue())
+			page, err := u.ReadPage("root/", storage.PageOptions{Limit: 1})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(page.Data).To(Equal([]byte("[{\"name\":\"newbie\"}]")))
+			page, err = u.ReadPage("root/", storage.PageOptions{Token: page.Next, Limit: 1})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(page.Keys).To(Equal([]string{"root/child1"}))
+			Expect(page.Data).To(Equal([]byte("[" + string(child1) + "]")))
+			Expect(page.Next).To(BeEmpty())
 		})
 	})
 
@@ -179,4 +469,206 @@ var _ = Describe("UnionedCache", func() {
 			})
 		})
 	})
+
+	Describe("Deleting trees", func() {
+		It("should hide read-only objects beneath it with a whiteout", func() {
+			Expect(u.Write("root/child1/nest/hand", []byte("\"hand\""))).To(Succeed())
+			Expect(u.DeleteTree("root/child1")).To(BeTrue())
+			Expect(u.Exists("root/child1")).To(BeFalse())
+			Expect(u.Exists("root/child1/nest/arm")).To(BeFalse())
+			Expect(u.Exists("root/child1/nest/hand")).To(BeFalse())
+			_, err = u.Read("root/child1/nest/leg")
+			Expect(storage.IsObjectNotFound(err)).To(BeTrue())
+			_, err = u.List("root/child1/nest/")
+			Expect(storage.IsPrefixNotFound(err)).To(BeTrue())
+			Expect(u.ReadList("root/")).To(Equal([]byte("[" + string(child2) + "]")))
+		})
+		It("should show objects written beneath it afterwards", func() {
+			Expect(u.DeleteTree("root/child1/")).To(BeTrue())
+			Expect(u.Exists("root/child1")).To(BeTrue())
+			Expect(u.Write("root/child1/leg", []byte("\"leg\""))).To(Succeed())
+			Expect(u.List("root/child1/")).To(Equal([]string{"root/child1/leg"}))
+			Expect(u.ReadList("root/child1/")).To(Equal([]byte("[\"leg\"]")))
+			Expect(u.Delete("root/child1/leg")).To(BeTrue())
+			Expect(u.Exists("root/child1/leg")).To(BeFalse())
+		})
+		It("should keep whiteouts in snapshots and forks", func() {
+			snapshot, err := u.Snapshot()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(u.DeleteTree("root/child1")).To(BeTrue())
+			f, err := u.Fork()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(f.Exists("root/child1/nest/arm")).To(BeFalse())
+
+			Expect(u.Restore(snapshot)).To(Succeed())
+			Expect(u.Exists("root/child1/nest/arm")).To(BeTrue())
+			Expect(f.Exists("root/child1/nest/arm")).To(BeFalse())
+		})
+		It("should fail for missing trees", func() {
+			Expect(u.DeleteTree("missing")).To(BeFalse())
+		})
+		It("should fail for trees with nothing left in them", func() {
+			// root/child2/nest is an empty directory among the fixtures
+			Expect(u.DeleteTree("root/child2/nest/")).To(BeFalse())
+			Expect(u.Delete("root/child2")).To(BeTrue())
+			Expect(u.DeleteTree("root/child2")).To(BeFalse())
+			Expect(u.DeleteTree("root/child1")).To(BeTrue())
+			Expect(u.DeleteTree("root/child1")).To(BeFalse())
+		})
+	})
+
+	Describe("Concurrent access", func() {
+		It("should be safe for parallel readers and writers", func() {
+			var wg sync.WaitGroup
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func(key string) {
+					defer wg.Done()
+					defer GinkgoRecover()
+					for j := 0; j < 100; j++ {
+						Expect(u.Write(key, child1)).To(Succeed())
+						Expect(u.Read("root/child2")).To(Equal(child2))
+						Expect(u.Exists(key)).To(BeTrue())
+						Expect(u.List("root/")).To(ContainElement("root/child2"))
+						Expect(u.ReadList("root/")).To(ContainSubstring("\"kid\""))
+						Expect(u.Delete(key)).To(BeTrue())
+					}
+				}(fmt.Sprintf("root/worker%d", i))
+			}
+			wg.Wait()
+			Expect(u.List("root/")).To(Equal([]string{"root/child1", "root/child2"}))
+		})
+	})
+
+	Describe("Stacking several layers", func() {
+		var l *storage.UnionedCache
+		teen := []byte("{\"name\":\"teen\"}")
+		tot := []byte("{\"name\":\"tot\"}")
+
+		BeforeEach(func() {
+			suite := storage.NewInMemoryCache()
+			Expect(suite.Write("root/child2", teen)).To(Succeed())
+			Expect(suite.Write("root/child3", tot)).To(Succeed())
+			l = storage.NewUnionedLayers(storage.NewInMemoryCache(), storage.NewFixtureStorage(dir), suite)
+		})
+
+		It("should read from the topmost layer", func() {
+			Expect(l.Read("root")).To(Equal(root))
+			Expect(l.Read("root/child1")).To(Equal(child1))
+			Expect(l.Read("root/child2")).To(Equal(teen))
+			Expect(l.Read("root/child3")).To(Equal(tot))
+		})
+		It("should list children from every layer", func() {
+			Expect(l.List("root/")).To(Equal([]string{"root/child1", "root/child2", "root/child3"}))
+			Expect(l.ReadList("root/")).To(Equal([]byte("[{\"name\":\"baby\"},{\"name\":\"teen\"},{\"name\":\"tot\"}]")))
+		})
+		It("should list prefixes found in only one layer", func() {
+			Expect(l.List("root/child1/nest/")).To(Equal([]string{"root/child1/nest/arm", "root/child1/nest/leg"}))
+		})
+		It("should fail on prefixes missing from every layer", func() {
+			Expect(l.List("root/child4/nest/")).Error().To(MatchError(HaveSuffix(" no such prefix record")))
+		})
+		It("should hide objects in every lower layer with a hole", func() {
+			Expect(l.Delete("root/child2")).To(BeTrue())
+			Expect(l.Exists("root/child2")).To(BeFalse())
+			Expect(l.Read("root/child2")).Error().To(MatchError(HaveSuffix(" no such object record")))
+			Expect(l.List("root/")).To(Equal([]string{"root/child1", "root/child3"}))
+		})
+		It("should hide lower layers after deleting an overriding write", func() {
+			Expect(l.Write("root/child3", child2)).To(Succeed())
+			Expect(l.Read("root/child3")).To(Equal(child2))
+			Expect(l.Delete("root/child3")).To(BeTrue())
+			Expect(l.Exists("root/child3")).To(BeFalse())
+			Expect(l.List("root/")).To(Equal([]string{"root/child1", "root/child2"}))
+		})
+	})
+
+	Describe("Snapshots", func() {
+		var su *storage.UnionedCache
+		var s storage.Snapshotter
+		guy := []byte("\"guy\"")
+
+		BeforeEach(func() {
+			su = storage.NewUnionedCache(dir)
+			s = su // force breakage if we fail to implement the interface
+			Expect(su.Write("root/other", guy)).To(Succeed())
+			Expect(su.Delete("root/child2")).To(BeTrue())
+		})
+
+		It("should restore written objects and holes", func() {
+			snapshot, err := s.Snapshot()
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(su.Delete("root/other")).To(BeTrue())
+			Expect(su.Delete("root/child1")).To(BeTrue())
+			Expect(su.Write("root/child2", child2)).To(Succeed())
+			Expect(su.List("root/")).To(Equal([]string{"root/child2"}))
+
+			Expect(s.Restore(snapshot)).To(Succeed())
+			Expect(su.List("root/")).To(Equal([]string{"root/child1", "root/other"}))
+			Expect(su.Read("root/other")).To(Equal(guy))
+			Expect(su.Exists("root/child2")).To(BeFalse())
+		})
+		It("should roll back to the same checkpoint repeatedly", func() {
+			Expect(s.PushCheckpoint()).To(Succeed())
+			for i := 0; i < 2; i++ {
+				Expect(su.Write("root/child2", child2)).To(Succeed())
+				Expect(s.RollbackCheckpoint()).To(Succeed())
+				Expect(su.ReadList("root/")).To(Equal([]byte("[{\"name\":\"baby\"},\"guy\"]")))
+			}
+			Expect(s.PopCheckpoint()).To(Succeed())
+			Expect(s.PopCheckpoint()).To(MatchError(storage.ErrNoCheckpoint))
+		})
+		It("should require a writable layer that supports snapshots", func() {
+			fu := storage.NewUnionedLayers(storage.NewFileStorage(GinkgoT().TempDir()), storage.NewFixtureStorage(dir))
+			Expect(fu.Snapshot()).Error().To(MatchError(storage.ErrSnapshotsUnsupported))
+			Expect(fu.PushCheckpoint()).To(MatchError(storage.ErrSnapshotsUnsupported))
+		})
+	})
+
+	Describe("Forks", func() {
+		var parent *storage.UnionedCache
+		var f storage.Forker
+		guy := []byte("\"guy\"")
+
+		BeforeEach(func() {
+			parent = storage.NewUnionedCache(dir)
+			f = parent // force breakage if we fail to implement the interface
+			Expect(parent.Write("root/other", guy)).To(Succeed())
+			Expect(parent.Delete("root/child2")).To(BeTrue())
+		})
+
+		It("should share written objects and holes", func() {
+			fork, err := f.Fork()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fork.List("root/")).To(Equal([]string{"root/child1", "root/other"}))
+			Expect(fork.Read("root/other")).To(Equal(guy))
+			Expect(fork.Exists("root/child2")).To(BeFalse())
+		})
+		It("should isolate writes and deletes in either cache", func() {
+			fork, err := f.Fork()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fork.Write("root/child2", child2)).To(Succeed())
+			Expect(fork.Delete("root/other")).To(BeTrue())
+			Expect(parent.Delete("root/child1")).To(BeTrue())
+
+			Expect(fork.List("root/")).To(Equal([]string{"root/child1", "root/child2"}))
+			Expect(parent.List("root/")).To(Equal([]string{"root/other"}))
+		})
+		It("should isolate trees deleted in either cache", func() {
+			fork, err := f.Fork()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fork.DeleteTree("root/")).To(BeTrue())
+			Expect(fork.Write("root/child2", child2)).To(Succeed())
+			Expect(parent.DeleteTree("root/child1")).To(BeTrue())
+
+			Expect(fork.List("root/")).To(Equal([]string{"root/child2"}))
+			Expect(parent.List("root/")).To(Equal([]string{"root/other"}))
+			Expect(parent.Exists("root/child2")).To(BeFalse())
+		})
+		It("should require a writable layer that supports forks", func() {
+			fu := storage.NewUnionedLayers(storage.NewFileStorage(GinkgoT().TempDir()), storage.NewFixtureStorage(dir))
+			Expect(fu.Fork()).Error().To(MatchError(storage.ErrForksUnsupported))
+		})
+	})
 })
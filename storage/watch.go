@@ -0,0 +1,192 @@
+package storage
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+// EventType says how an object changed.
+type EventType int
+
+const (
+	EventCreated EventType = iota + 1
+	EventUpdated
+	EventDeleted
+)
+
+var eventTypes = []string{"", "created", "updated", "deleted"}
+
+func (t EventType) String() string {
+	if t < 0 || int(t) >= len(eventTypes) {
+		return "unknown"
+	}
+	return eventTypes[t]
+}
+
+// Event describes a change to an object.  Data and Version are the object's new contents
+// and version, which are empty for deletes.
+type Event struct {
+	Type     EventType
+	Location string
+	Data     []byte
+	Version  uint64
+}
+
+// Watcher is implemented by stores that can report changes to their objects.
+type Watcher interface {
+	// Watch sends an event for every object written or deleted beneath a prefix from now
+	// on, in order, until ctx is done, when it closes the channel.  Events are queued for
+	// slow receivers, so they never block writers.  Clearing, resetting or restoring a
+	// store does not send any events.
+	Watch(ctx context.Context, prefix string) <-chan Event
+}
+
+// closedEvents returns a closed channel, which wrappers return from Watch when the store
+// they wrap cannot be watched.
+func closedEvents() <-chan Event {
+	events := make(chan Event)
+	close(events)
+	return events
+}
+
+// watchers is the set of subscriptions to a store, shared by each Watcher implementation.
+type watchers struct {
+	mu      sync.Mutex
+	subs    map[*subscription]struct{}
+	holding bool
+	held    []Event
+}
+
+// subscription queues the events for a single call to Watch.
+type subscription struct {
+	prefix string
+	mu     sync.Mutex
+	queue  []Event
+	ready  chan struct{}
+}
+
+func (w *watchers) watch(ctx context.Context, prefix string) <-chan Event {
+	sub := &subscription{prefix: prefix, ready: make(chan struct{}, 1)}
+	w.mu.Lock()
+	if w.subs == nil {
+		w.subs = map[*subscription]struct{}{}
+	}
+	w.subs[sub] = struct{}{}
+	w.mu.Unlock()
+
+	events := make(chan Event)
+	go func() {
+		defer close(events)
+		defer w.remove(sub)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-sub.ready:
+			}
+			for _, e := range sub.take() {
+				select {
+				case events <- e:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return events
+}
+
+func (w *watchers) remove(sub *subscription) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.subs, sub)
+}
+
+// active returns whether there are any subscriptions, so that stores can skip the work
+// of describing changes that nobody is watching.
+func (w *watchers) active() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.subs) > 0
+}
+
+// publish queues an event for every subscription to a prefix of its location, unless
+// events are being held back.  Stores publish events while holding their write lock, so
+// they are queued in order.
+func (w *watchers) publish(e Event) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.holding {
+		w.held = append(w.held, e)
+		return
+	}
+	w.push(e)
+}
+
+// push queues an event for every subscription to a prefix of its location.  It must be
+// called with the lock held.
+func (w *watchers) push(e Event) {
+	for sub := range w.subs {
+		if strings.HasPrefix(e.Location, sub.prefix) {
+			sub.push(e)
+		}
+	}
+}
+
+// hold holds back the events published from now on, until they are released or dropped,
+// so that stores can publish the events for a transaction only once it has been applied.
+func (w *watchers) hold() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.holding = true
+}
+
+// release publishes the events held back since hold was called, in order.
+func (w *watchers) release() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, e := range w.held {
+		w.push(e)
+	}
+	w.holding, w.held = false, nil
+}
+
+// drop discards the events held back since hold was called.
+func (w *watchers) drop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.holding, w.held = false, nil
+}
+
+// written publishes an event for an object that was written.
+func (w *watchers) written(location string, data []byte, version uint64, existed bool) {
+	e := Event{Type: EventCreated, Location: location, Data: data, Version: version}
+	if existed {
+		e.Type = EventUpdated
+	}
+	w.publish(e)
+}
+
+// deleted publishes an event for an object that was deleted.
+func (w *watchers) deleted(location string) {
+	w.publish(Event{Type: EventDeleted, Location: location})
+}
+
+func (sub *subscription) push(e Event) {
+	sub.mu.Lock()
+	sub.queue = append(sub.queue, e)
+	sub.mu.Unlock()
+	select {
+	case sub.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (sub *subscription) take() []Event {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	queue := sub.queue
+	sub.queue = nil
+	return queue
+}
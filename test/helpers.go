@@ -1,17 +1,31 @@
 package test
 
 import (
+	"embed"
 	"github/joekhoobyar/epigon/rest"
+	"io/fs"
 	"net/http"
 	"path"
 	"runtime"
 )
 
+//go:embed all:fixtures
+var fixtures embed.FS
+
 func FixtureDir() string {
 	_, filename, _, _ := runtime.Caller(0)
 	return path.Clean(path.Join(path.Dir(filename), "fixtures"))
 }
 
+// FixtureFS returns the same fixtures as FixtureDir, compiled into the test binary.
+func FixtureFS() fs.FS {
+	fsys, err := fs.Sub(fixtures, "fixtures")
+	if err != nil {
+		panic(err)
+	}
+	return fsys
+}
+
 func GET(srv *rest.Server, path string) (*http.Response, error) {
 	url := srv.Server.URL + path
 	return http.Get(url)